@@ -12,7 +12,7 @@ import (
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		templates.ExecuteTemplate(w, "register.html", nil)
+		templates.ExecuteTemplate(w, "register.html", PageData{CSRFToken: csrfToken(w, r)})
 		return
 	}
 
@@ -26,32 +26,38 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", username, hashedPassword)
+	result, err := db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", username, hashedPassword)
 	if err != nil {
 		http.Error(w, "Username may already exist", 400)
 		return
 	}
 
-	// Set login cookie after successful registration
-	http.SetCookie(w, &http.Cookie{
-		Name:  "username",
-		Value: username,
-		Path:  "/",
-	})
+	userID, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Failed to retrieve userID", 500)
+		return
+	}
+
+	// log in after successful registration
+	if err := createSession(w, r, int(userID)); err != nil {
+		http.Error(w, "Failed to create session", 500)
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		templates.ExecuteTemplate(w, "login.html", nil)
+		templates.ExecuteTemplate(w, "login.html", PageData{CSRFToken: csrfToken(w, r)})
 		return
 	}
 
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 
+	var userID int
 	var storedHash string
-	err := db.QueryRow("SELECT password_hash FROM users WHERE username = ?", username).Scan(&storedHash)
+	err := db.QueryRow("SELECT id, password_hash FROM users WHERE username = ?", username).Scan(&userID, &storedHash)
 	if err != nil {
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
@@ -63,28 +69,28 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:  "username",
-		Value: username,
-		Path:  "/",
-	})
+	if err := createSession(w, r, userID); err != nil {
+		http.Error(w, "Failed to create session", 500)
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// returns the logged in username, or "" if there's no valid session or api token
 func getUsername(r *http.Request) string {
-	cookie, err := r.Cookie("username")
-	if err != nil {
+	_, username, ok := getAuthUser(r, scopeRead)
+	if !ok {
 		return ""
 	}
-	return cookie.Value
+	return username
 }
 
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:   "username",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1, // kills it
-	})
+	// a POST, so the csrf check keeps other sites from logging people out
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	destroySession(w, r)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
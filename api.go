@@ -0,0 +1,456 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// json api, mounted under /api/v1. responses mirror the structs the html
+// templates get, errors always look like {"error": "..."}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type createPostRequest struct {
+	Content  string               `json:"content"`
+	Tags     []string             `json:"tags"`
+	ParentID *int                 `json:"parent_id"`
+	PostType string               `json:"post_type"`
+	Journal  string               `json:"journal"` // slug, journal posts only
+	Media    []attachMediaRequest `json:"media"`
+}
+
+// either field can be left out to keep it as it is
+type editPostRequest struct {
+	Content *string   `json:"content"`
+	Tags    *[]string `json:"tags"`
+}
+
+type previewRequest struct {
+	Content string `json:"content"`
+}
+
+type previewResponse struct {
+	HTML string `json:"html"`
+}
+
+// a pending upload from POST /api/v1/media to attach to the new post
+type attachMediaRequest struct {
+	ID      int    `json:"id"`
+	AltText string `json:"alt_text"`
+}
+
+type pendingMediaResponse struct {
+	ID        int    `json:"id"`
+	Filename  string `json:"filename"`
+	URL       string `json:"url"`
+	ThumbURL  string `json:"thumb_url,omitempty"`
+	MediumURL string `json:"medium_url,omitempty"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+}
+
+type likeResponse struct {
+	Liked bool `json:"liked"`
+	Likes int  `json:"likes"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding json response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{Error: message})
+}
+
+// parses the {id} path segment, writes the error itself if it's bad
+func apiPostID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	postID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid post id")
+		return 0, false
+	}
+	return postID, true
+}
+
+// GET /api/v1/timeline?before=&after=&limit=
+func apiTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	posts, pagination, err := getTimelinePosts(pageRequestFromQuery(r))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if posts == nil {
+		posts = []Post{}
+	}
+
+	writeJSON(w, http.StatusOK, PageData{
+		Username:   getUsername(r),
+		Posts:      posts,
+		Pagination: &pagination,
+	})
+}
+
+// GET /api/v1/posts/{id} - post with its replies
+func apiThreadHandler(w http.ResponseWriter, r *http.Request) {
+	postID, ok := apiPostID(w, r)
+	if !ok {
+		return
+	}
+
+	post, err := getPost(postID)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "post not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, PageData{
+		Username: getUsername(r),
+		Post:     post,
+	})
+}
+
+// POST /api/v1/posts - creates a post, or a reply when parent_id is set
+func apiCreatePostHandler(w http.ResponseWriter, r *http.Request) {
+	userID, username, ok := getAuthUser(r, scopeWrite)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	var req createPostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json body")
+		return
+	}
+
+	if strings.TrimSpace(req.Content) == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing content")
+		return
+	}
+	if err := checkPostLength(req.Content); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := normalizeTags(req.Tags); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.PostType == "" {
+		req.PostType = "regular"
+	}
+	if req.PostType != "regular" && req.PostType != "journal" {
+		writeJSONError(w, http.StatusBadRequest, "post_type must be regular or journal")
+		return
+	}
+
+	if !canHaveTags(req.ParentID) && len(req.Tags) > 0 {
+		writeJSONError(w, http.StatusBadRequest, errReplyTags.Error())
+		return
+	}
+
+	var journalID *int
+	if req.PostType == "journal" {
+		journal, err := openJournal(req.Journal, username)
+		if err != nil {
+			writeJSONError(w, journalErrorStatus(err), err.Error())
+			return
+		}
+		journalID = &journal.ID
+	}
+
+	if req.ParentID != nil {
+		if parent, err := getPost(*req.ParentID); err == sql.ErrNoRows || (err == nil && parent.Deleted) {
+			writeJSONError(w, http.StatusNotFound, "parent post not found")
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	ids := make([]int, len(req.Media))
+	alts := make([]string, len(req.Media))
+	for i, m := range req.Media {
+		ids[i], alts[i] = m.ID, m.AltText
+	}
+	media, err := getPendingMedia(userID, ids, alts)
+	if err != nil {
+		status, message := imageErrorStatus(err)
+		writeJSONError(w, status, message)
+		return
+	}
+
+	postID, err := createPost(username, req.Content, media, req.PostType, journalID, req.ParentID, strings.Join(req.Tags, ","))
+	var badAttachment attachmentError
+	if errors.As(err, &badAttachment) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	post, err := getPost(postID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, post)
+}
+
+// PATCH /api/v1/posts/{id} - edits your own post's content and/or tags,
+// the old version of the content is kept
+func apiEditPostHandler(w http.ResponseWriter, r *http.Request) {
+	_, username, ok := getAuthUser(r, scopeWrite)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	postID, ok := apiPostID(w, r)
+	if !ok {
+		return
+	}
+
+	var req editPostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json body")
+		return
+	}
+	if req.Content == nil && req.Tags == nil {
+		writeJSONError(w, http.StatusBadRequest, "nothing to change, send content or tags")
+		return
+	}
+	if req.Content != nil && strings.TrimSpace(*req.Content) == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing content")
+		return
+	}
+	if req.Content != nil {
+		if err := checkPostLength(*req.Content); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	var tags *[]string
+	if req.Tags != nil {
+		normalized, err := normalizeTags(*req.Tags)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		tags = &normalized
+	}
+
+	err := editPost(postID, username, req.Content, tags)
+	var invalidTag invalidTagError
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "post not found")
+		return
+	} else if err == errNotPostAuthor {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	} else if err == errReplyTags || err == errPostTooLong || errors.As(err, &invalidTag) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	post, err := getPost(postID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, post)
+}
+
+// DELETE /api/v1/posts/{id} - deletes your own post, replies stay
+func apiDeletePostHandler(w http.ResponseWriter, r *http.Request) {
+	_, username, ok := getAuthUser(r, scopeWrite)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	postID, ok := apiPostID(w, r)
+	if !ok {
+		return
+	}
+
+	err := deletePost(postID, username)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "post not found")
+		return
+	} else if err == errNotPostAuthor {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/v1/posts/{id}/like - toggles the like
+func apiLikeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := getAuthUser(r, scopeWrite)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	postID, ok := apiPostID(w, r)
+	if !ok {
+		return
+	}
+
+	liked, err := toggleLike(userID, postID)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "post not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to toggle like")
+		return
+	}
+
+	resp := likeResponse{Liked: liked}
+	err = db.QueryRow("SELECT COUNT(*) FROM likes WHERE post_id = ?", postID).Scan(&resp.Likes)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// POST /api/v1/preview - renders markdown the way the post would show it
+func apiPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := getAuthUser(r, scopeRead); !ok {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	var req previewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json body")
+		return
+	}
+	if err := checkPostLength(req.Content); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, previewResponse{HTML: string(renderMarkdown(req.Content))})
+}
+
+// GET /api/v1/tags?sort=popular|recent
+func apiTagsHandler(w http.ResponseWriter, r *http.Request) {
+	tags, err := getAllTags(tagSortFromQuery(r))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if tags == nil {
+		tags = []Tag{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]Tag{"tags": tags})
+}
+
+// GET /api/v1/trending?window= - trending tags, from the cache the
+// background worker keeps
+func apiTrendingHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, getTrendingTags(r.URL.Query().Get("window")))
+}
+
+// GET /api/v1/tags/{name}?before=&after=&limit= - posts with the tag
+func apiTagHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := resolveTag(db, r.PathValue("name"))
+	var invalid invalidTagError
+	if errors.As(err, &invalid) {
+		writeJSONError(w, http.StatusNotFound, "tag not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	posts, pagination, err := getTagPosts(name, pageRequestFromQuery(r))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if posts == nil {
+		posts = []Post{}
+	}
+
+	writeJSON(w, http.StatusOK, TagPageData{
+		Username:   getUsername(r),
+		Tag:        name,
+		Posts:      posts,
+		Pagination: &pagination,
+	})
+}
+
+// GET /api/v1/journals - all journals, the most recently started first
+func apiJournalsHandler(w http.ResponseWriter, r *http.Request) {
+	journals, err := getJournals()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if journals == nil {
+		journals = []Journal{}
+	}
+	writeJSON(w, http.StatusOK, journals)
+}
+
+// GET /api/v1/journal?before=&after=&limit= - the default journal's posts
+// grouped by day. GET /api/v1/journals/{slug} for the others
+func apiJournalHandler(w http.ResponseWriter, r *http.Request) {
+	journal, err := getJournal(r.PathValue("slug"))
+	if err == errJournalNotFound {
+		writeJSONError(w, http.StatusNotFound, "journal not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	posts, pagination, err := getJournalPosts(journal, pageRequestFromQuery(r))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	dayGroups := groupPostsByDayFixed(journal, posts)
+	if dayGroups == nil {
+		dayGroups = []DayGroup{}
+	}
+
+	writeJSON(w, http.StatusOK, JournalPageData{
+		Username:   getUsername(r),
+		Journal:    journal,
+		DayGroups:  dayGroups,
+		Pagination: &pagination,
+	})
+}
+
+// anything else under /api/ gets a json 404 instead of the timeline
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, "not found")
+}
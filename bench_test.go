@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// feed loading against a throwaway db, to see how the feeds scale:
+//
+//	go test -run ^$ -bench . [-benchposts 100000]
+var benchPosts = flag.Int("benchposts", 100000, "how many posts the benchmarks seed their db with")
+
+// a fresh db seeded with benchPosts posts, returns the journal they're in
+func openBenchDB(b *testing.B) Journal {
+	b.Helper()
+	openTestDB(b)
+
+	// the journal the migrations start with
+	journal, err := getJournal("")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := seedBenchData(*benchPosts, journal.ID); err != nil {
+		b.Fatal(err)
+	}
+	return journal
+}
+
+func BenchmarkTimeline(b *testing.B) {
+	openBenchDB(b)
+
+	b.Run("first page", func(b *testing.B) {
+		for b.Loop() {
+			if _, _, err := getTimelinePosts(PageRequest{Limit: pageSize}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("deep page", func(b *testing.B) {
+		for b.Loop() {
+			if _, _, err := getTimelinePosts(PageRequest{Before: *benchPosts / 2, Limit: pageSize}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkJournal(b *testing.B) {
+	journal := openBenchDB(b)
+
+	for b.Loop() {
+		if _, _, err := getJournalPosts(journal, PageRequest{Limit: pageSize}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkThread(b *testing.B) {
+	openBenchDB(b)
+
+	for b.Loop() {
+		if _, err := getPost(1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// fake users, posts, replies, tags and likes, spread over the last year
+func seedBenchData(numPosts, journalID int) error {
+	const numUsers = 50
+	const numTags = 30
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := 1; i <= numUsers; i++ {
+		if _, err := tx.Exec("INSERT INTO users (username, password_hash) VALUES (?, '')", fmt.Sprintf("user%d", i)); err != nil {
+			return err
+		}
+	}
+	for i := 1; i <= numTags; i++ {
+		if _, err := tx.Exec("INSERT INTO tags (name) VALUES (?)", fmt.Sprintf("tag%d", i)); err != nil {
+			return err
+		}
+	}
+
+	insertPost, err := tx.Prepare("INSERT INTO posts (username, content, parent_id, post_type, journal_id, created_at) VALUES (?, ?, ?, ?, ?, datetime('now', ?))")
+	if err != nil {
+		return err
+	}
+	insertTag, err := tx.Prepare("INSERT OR IGNORE INTO post_tags (post_id, tag_id) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	insertLike, err := tx.Prepare("INSERT OR IGNORE INTO likes (user_id, post_id) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 1; i <= numPosts; i++ {
+		// a post every ~5 minutes, oldest first
+		age := fmt.Sprintf("-%d seconds", (numPosts-i)*300)
+
+		var parentID, postJournalID any
+		postType := "regular"
+		switch {
+		case i > 1 && rng.Intn(10) < 3:
+			parentID = rng.Intn(i-1) + 1
+		case rng.Intn(10) == 0:
+			postType = "journal"
+			postJournalID = journalID
+		}
+
+		username := fmt.Sprintf("user%d", rng.Intn(numUsers)+1)
+		if _, err := insertPost.Exec(username, fmt.Sprintf("post number %d", i), parentID, postType, postJournalID, age); err != nil {
+			return err
+		}
+
+		for j := rng.Intn(4); j > 0; j-- {
+			if _, err := insertTag.Exec(i, rng.Intn(numTags)+1); err != nil {
+				return err
+			}
+		}
+		for j := rng.Intn(6); j > 0; j-- {
+			if _, err := insertLike.Exec(rng.Intn(numUsers)+1, i); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// server settings, read from environment variables so a deploy can change
+// them without a rebuild
+
+// default number of posts per feed page (TERRACOTTA_PAGE_SIZE)
+var pageSize = envInt("TERRACOTTA_PAGE_SIZE", 20)
+
+// biggest page a client can ask for with ?limit=
+const maxPageSize = 100
+
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Printf("Ignoring invalid %s=%q, using %d", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func envBool(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q, using %t", name, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+func envString(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const csrfCookieName = "csrf"
+const csrfFieldName = "csrf_token"
+const csrfHeaderName = "X-CSRF-Token"
+
+// returns the csrf token of the current session, if there is one
+func sessionCSRFToken(r *http.Request) (string, bool) {
+	cookieToken, ok := sessionCookie(r)
+	if !ok {
+		return "", false
+	}
+
+	var token string
+	err := db.QueryRow(
+		"SELECT csrf_token FROM sessions WHERE token_hash = ? AND expires_at > datetime('now')",
+		hashToken(cookieToken)).Scan(&token)
+	if err != nil || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// token the next POST from this client has to carry. logged in users get
+// their session's token, anonymous users (login/register forms) get one
+// stored in a cookie
+func expectedCSRFToken(r *http.Request) string {
+	if token, ok := sessionCSRFToken(r); ok {
+		return token
+	}
+	if cookie, err := r.Cookie(csrfCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// returns the token to embed in forms, issuing an anonymous one if needed
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if token := expectedCSRFToken(r); token != "" {
+		return token
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		log.Printf("Error generating csrf token: %v", err)
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// rejects state-changing requests that don't carry a valid csrf token,
+// either as the X-CSRF-Token header or the csrf_token form field.
+// requests with a bearer token are exempt, they're authenticated by the
+// token alone (see sessionCookie). other Authorization headers, like basic
+// auth in front of the site, are sent by browsers on their own and aren't.
+// the form is only parsed without the header, and limitRequestBody has to
+// be in front of this so that can't read an unbounded body
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// api token requests don't use cookies, so there's nothing to forge
+		if _, ok := bearerToken(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reject := func(status int, message string) {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeJSONError(w, status, message)
+				return
+			}
+			http.Error(w, strings.ToUpper(message[:1])+message[1:], status)
+		}
+
+		expected := expectedCSRFToken(r)
+		submitted := r.Header.Get(csrfHeaderName)
+		if submitted == "" {
+			if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					reject(http.StatusRequestEntityTooLarge, fmt.Sprintf("request is larger than %d MB", tooLarge.Limit>>20))
+					return
+				}
+				reject(http.StatusBadRequest, "invalid form")
+				return
+			}
+			submitted = r.FormValue(csrfFieldName)
+		}
+
+		if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(submitted)) != 1 {
+			reject(http.StatusForbidden, "invalid csrf token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
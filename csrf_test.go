@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// only bearer requests skip the csrf check, and those can't use the
+// session cookie, so cookie-only pages like /tokens can't be forged
+func TestCSRFMiddleware(t *testing.T) {
+	openTestDB(t)
+	if _, err := db.Exec("INSERT INTO users (id, username, password_hash) VALUES (1, 'alice', '')"); err != nil {
+		t.Fatal(err)
+	}
+	login := httptest.NewRecorder()
+	if err := createSession(login, httptest.NewRequest("POST", "/login", nil), 1); err != nil {
+		t.Fatal(err)
+	}
+	cookie := login.Result().Cookies()[0]
+	var csrf string
+	if err := db.QueryRow("SELECT csrf_token FROM sessions").Scan(&csrf); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := csrfMiddleware(http.HandlerFunc(tokensHandler))
+	tests := []struct {
+		name          string
+		authorization string
+		csrfToken     string
+		status        int
+		created       bool
+	}{
+		{name: "no csrf token", status: http.StatusForbidden},
+		{name: "wrong csrf token", csrfToken: "nope", status: http.StatusForbidden},
+		// browsers add this on their own behind basic auth
+		{name: "basic auth", authorization: "Basic YWxpY2U6c2VjcmV0", status: http.StatusForbidden},
+		{name: "bearer token", authorization: "Bearer tc_forged", status: http.StatusSeeOther},
+		{name: "valid csrf token", csrfToken: csrf, status: http.StatusOK, created: true},
+	}
+	for _, test := range tests {
+		form := url.Values{"name": {"script"}, "scope": {scopeWrite}}
+		if test.csrfToken != "" {
+			form.Set(csrfFieldName, test.csrfToken)
+		}
+		r := httptest.NewRequest("POST", "/tokens", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		var tokens int
+		if err := db.QueryRow("SELECT COUNT(*) FROM api_tokens").Scan(&tokens); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != test.status || (tokens > 0) != test.created {
+			t.Errorf("%s: status %d with %d tokens, want %d and created=%v", test.name, w.Code, tokens, test.status, test.created)
+		}
+	}
+
+	// a bearer request can't log the session out either
+	r := httptest.NewRequest("POST", "/logout", nil)
+	r.AddCookie(cookie)
+	r.Header.Set("Authorization", "Bearer tc_forged")
+	csrfMiddleware(http.HandlerFunc(logoutHandler)).ServeHTTP(httptest.NewRecorder(), r)
+	if _, _, ok := getSessionUser(withCookie(cookie)); !ok {
+		t.Error("a bearer request destroyed the session")
+	}
+}
+
+func withCookie(cookie *http.Cookie) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	return r
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// authors can delete their posts. deleting only sets deleted_at, so replies
+// keep their parent and the thread shows a "[deleted]" tombstone in its
+// place. after the retention period the purge job removes the post for good
+
+// how long deleted posts are kept before they're purged
+// (TERRACOTTA_DELETED_RETENTION_DAYS)
+var deletedPostRetention = time.Duration(envInt("TERRACOTTA_DELETED_RETENTION_DAYS", 30)) * 24 * time.Hour
+
+// how often the purge job runs
+const deletedPostPurgeInterval = 6 * time.Hour
+
+// soft deletes the post. sql.ErrNoRows if it doesn't exist or is already
+// deleted, errNotPostAuthor if it isn't theirs
+func deletePost(postID int, username string) error {
+	var author string
+	err := db.QueryRow("SELECT username FROM posts WHERE id = ? AND deleted_at IS NULL", postID).Scan(&author)
+	if err != nil {
+		return err
+	}
+	if author != username {
+		return errNotPostAuthor
+	}
+
+	_, err = db.Exec("UPDATE posts SET deleted_at = CURRENT_TIMESTAMP WHERE id = ? AND deleted_at IS NULL", postID)
+	return err
+}
+
+// hides everything a deleted post said, leaving just its place in the thread
+func (p *Post) tombstone() {
+	p.Content = "[deleted]"
+	p.contentHTML = ""
+	p.Username = ""
+	p.Media = nil
+	p.Tags = nil
+	p.EditedAt = nil
+}
+
+// hard deletes posts that were deleted longer ago than the retention period,
+// along with their likes, tags, media, revisions and mentions. a post that still has
+// replies keeps an empty row so the replies aren't orphaned, it goes once
+// they're gone too. returns how many posts were removed
+func purgeDeletedPosts() (int64, error) {
+	cutoff := fmt.Sprintf("-%d seconds", int(deletedPostRetention.Seconds()))
+	expired := "SELECT id FROM posts WHERE deleted_at IS NOT NULL AND deleted_at < datetime('now', ?)"
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"likes", "post_tags", "post_media", "post_revisions", "mentions"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE post_id IN ("+expired+")", cutoff); err != nil {
+			return 0, err
+		}
+	}
+	// rows that stay for their replies keep nothing of what the post said or who said it
+	_, err = tx.Exec("UPDATE posts SET content = '', content_html = '', username = '', edited_at = NULL WHERE id IN ("+expired+")", cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	// removing a reply can free up its parent, so keep going until nothing
+	// more can be removed
+	var removed int64
+	for {
+		result, err := tx.Exec(`
+			DELETE FROM posts
+			WHERE id IN (`+expired+`)
+			  AND NOT EXISTS (SELECT 1 FROM posts AS replies WHERE replies.parent_id = posts.id)
+		`, cutoff)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+		removed += n
+	}
+	return removed, tx.Commit()
+}
+
+// runs purgeDeletedPosts in the background forever
+func startDeletedPostPurge() {
+	go func() {
+		for {
+			removed, err := purgeDeletedPosts()
+			if err != nil {
+				log.Printf("Error purging deleted posts: %v", err)
+			} else if removed > 0 {
+				log.Printf("Purged %d deleted posts", removed)
+			}
+			// their tags may not be on anything else
+			if _, err := cleanupUnusedTags(); err != nil {
+				log.Printf("Error cleaning up tags: %v", err)
+			}
+			time.Sleep(deletedPostPurgeInterval)
+		}
+	}()
+}
+
+// form target for the delete button, POST /delete
+func deletePostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	_, username, ok := getAuthUser(r, scopeWrite)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	postID, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid post ID", 400)
+		return
+	}
+
+	post, err := getPost(postID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Post not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	err = deletePost(postID, username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Post not found", 404)
+		return
+	} else if err == errNotPostAuthor {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Printf("Error deleting post %d: %v", postID, err)
+		http.Error(w, "Failed to delete post", 500)
+		return
+	}
+
+	// back to the thread for a reply, otherwise to the feed the post was in
+	if post.ParentID != nil {
+		http.Redirect(w, r, threadURL(post), http.StatusSeeOther)
+	} else if post.PostType == "journal" {
+		journalPath := "/journal"
+		if journal, err := getPostJournal(postID); err == nil {
+			journalPath = journal.Path()
+		} else if err != sql.ErrNoRows {
+			log.Printf("Error loading journal of post %d: %v", postID, err)
+		}
+		http.Redirect(w, r, journalPath, http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
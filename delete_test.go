@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// a purged post that still has replies keeps its row, and nothing else
+func TestPurgeDeletedPosts(t *testing.T) {
+	openTestDB(t)
+	if _, err := db.Exec("INSERT INTO users (id, username, password_hash) VALUES (1, 'alice', '')"); err != nil {
+		t.Fatal(err)
+	}
+	parentID, err := createPost("alice", "my *secret* plans #plans", nil, "regular", nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "edited *secret* plans"
+	if err := editPost(parentID, "alice", &content, nil); err != nil {
+		t.Fatal(err)
+	}
+	replyID, err := createPost("alice", "a reply", nil, "regular", nil, &parentID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loneID, err := createPost("alice", "nobody replied", nil, "regular", nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := toggleLike(1, parentID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []int{parentID, loneID} {
+		if err := deletePost(id, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("UPDATE posts SET deleted_at = datetime('now', '-1 year') WHERE deleted_at IS NOT NULL"); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := purgeDeletedPosts()
+	if err != nil || removed != 1 {
+		t.Fatalf("purgeDeletedPosts = %d, %v, want 1 removed", removed, err)
+	}
+
+	if err := db.QueryRow("SELECT id FROM posts WHERE id = ?", loneID).Scan(new(int)); err != sql.ErrNoRows {
+		t.Errorf("post without replies is still there: %v", err)
+	}
+	if err := db.QueryRow("SELECT id FROM posts WHERE id = ? AND deleted_at IS NULL", replyID).Scan(new(int)); err != nil {
+		t.Errorf("the reply is gone: %v", err)
+	}
+
+	var username, storedContent string
+	var contentHTML sql.NullString
+	var editedAt sql.NullString
+	err = db.QueryRow("SELECT username, content, content_html, edited_at FROM posts WHERE id = ?", parentID).
+		Scan(&username, &storedContent, &contentHTML, &editedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "" || storedContent != "" || contentHTML.String != "" || editedAt.Valid {
+		t.Errorf("purged row kept username %q, content %q, content_html %q, edited_at %q", username, storedContent, contentHTML.String, editedAt.String)
+	}
+	for _, table := range []string{"likes", "post_tags", "post_media", "post_revisions", "mentions"} {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE post_id = ?", parentID).Scan(&n); err != nil || n != 0 {
+			t.Errorf("%s still has %d rows for the purged post (%v)", table, n, err)
+		}
+	}
+}
+
+// deleting a journal post goes back to the journal it was in
+func TestDeletePostHandlerJournalRedirect(t *testing.T) {
+	openTestDB(t)
+	if _, err := db.Exec("INSERT INTO users (id, username, password_hash) VALUES (1, 'alice', '')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := createJournal("cohort-2", "second cohort", "2026-01-01", nil); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := getJournal("cohort-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	postID, err := createPost("alice", "day one", nil, "journal", &journal.ID, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := httptest.NewRecorder()
+	if err := createSession(login, httptest.NewRequest("POST", "/login", nil), 1); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/delete", strings.NewReader(url.Values{"id": {strconv.Itoa(postID)}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(login.Result().Cookies()[0])
+	w := httptest.NewRecorder()
+	deletePostHandler(w, r)
+
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/journals/cohort-2" {
+		t.Errorf("delete = %d to %q, want a redirect to /journals/cohort-2", w.Code, w.Header().Get("Location"))
+	}
+}
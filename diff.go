@@ -0,0 +1,84 @@
+package main
+
+import "regexp"
+
+// word level diffs for the post history page
+
+// a run of text that's in both versions, or only in the old/new one
+type DiffPart struct {
+	Text string
+	Op   string // "equal", "delete" or "insert"
+}
+
+// words and the whitespace between them, so joining the tokens gives back
+// the original text
+var diffTokenPattern = regexp.MustCompile(`\s+|\S+`)
+
+// past this many token pairs the lcs table gets too big, and the diff just
+// shows the whole text as replaced
+const maxDiffCells = 4_000_000
+
+// diffs two texts word by word using the longest common subsequence
+func diffWords(oldText, newText string) []DiffPart {
+	a := diffTokenPattern.FindAllString(oldText, -1)
+	b := diffTokenPattern.FindAllString(newText, -1)
+
+	if len(a)*len(b) > maxDiffCells {
+		return mergeDiffParts([]DiffPart{{oldText, "delete"}, {newText, "insert"}})
+	}
+
+	// lcs[i][j] is the lcs length of a[i:] and b[j:]
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var parts []DiffPart
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			parts = append(parts, DiffPart{a[i], "equal"})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			parts = append(parts, DiffPart{a[i], "delete"})
+			i++
+		default:
+			parts = append(parts, DiffPart{b[j], "insert"})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		parts = append(parts, DiffPart{a[i], "delete"})
+	}
+	for ; j < len(b); j++ {
+		parts = append(parts, DiffPart{b[j], "insert"})
+	}
+	return mergeDiffParts(parts)
+}
+
+// joins neighbouring parts with the same op and drops empty ones
+func mergeDiffParts(parts []DiffPart) []DiffPart {
+	var merged []DiffPart
+	for _, part := range parts {
+		if part.Text == "" {
+			continue
+		}
+		if n := len(merged); n > 0 && merged[n-1].Op == part.Op {
+			merged[n-1].Text += part.Text
+			continue
+		}
+		merged = append(merged, part)
+	}
+	return merged
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffWords(t *testing.T) {
+	tests := []struct {
+		old, new string
+		want     []DiffPart
+	}{
+		{"", "", nil},
+		{"same text", "same text", []DiffPart{{"same text", "equal"}}},
+		{"", "new post", []DiffPart{{"new post", "insert"}}},
+		{"old post", "", []DiffPart{{"old post", "delete"}}},
+		{"the quick fox", "the slow fox", []DiffPart{
+			{"the ", "equal"}, {"quick", "delete"}, {"slow", "insert"}, {" fox", "equal"},
+		}},
+		{"hello world", "hello big world", []DiffPart{
+			{"hello ", "equal"}, {"big ", "insert"}, {"world", "equal"},
+		}},
+		{"a b c d", "a d", []DiffPart{
+			{"a ", "equal"}, {"b c ", "delete"}, {"d", "equal"},
+		}},
+		// words, not characters
+		{"cat", "cart", []DiffPart{{"cat", "delete"}, {"cart", "insert"}}},
+		// whitespace changes show up too
+		{"one two", "one\ntwo", []DiffPart{
+			{"one", "equal"}, {" ", "delete"}, {"\n", "insert"}, {"two", "equal"},
+		}},
+	}
+	for _, test := range tests {
+		if got := diffWords(test.old, test.new); !slices.Equal(got, test.want) {
+			t.Errorf("diffWords(%q, %q) = %v, want %v", test.old, test.new, got, test.want)
+		}
+	}
+}
+
+// the equal and deleted parts spell the old text, equal and inserted the new
+func TestDiffWordsRebuildsBothTexts(t *testing.T) {
+	pairs := [][2]string{
+		{"the quick brown fox jumps over the lazy dog", "a quick red fox jumped over the dog, lazily"},
+		{"  leading and trailing  ", "leading and\ttrailing"},
+		{"**markdown** with [a link](https://example.com)", "*markdown* with [the link](https://example.org) #tag"},
+		{"ünïcödé wörds 😀", "ünïcödé 😀 wörds"},
+		// too many tokens for the lcs table, the whole text is replaced
+		{strings.Repeat("a ", 3000), strings.Repeat("b ", 3000)},
+	}
+	for _, pair := range pairs {
+		parts := diffWords(pair[0], pair[1])
+		var old, new strings.Builder
+		for i, part := range parts {
+			if part.Text == "" || (i > 0 && parts[i-1].Op == part.Op) {
+				t.Errorf("diffWords(%q, %q) has empty or unmerged parts: %v", pair[0], pair[1], parts)
+			}
+			if part.Op != "insert" {
+				old.WriteString(part.Text)
+			}
+			if part.Op != "delete" {
+				new.WriteString(part.Text)
+			}
+		}
+		if old.String() != pair[0] || new.String() != pair[1] {
+			t.Errorf("diffWords(%q, %q) rebuilds %q and %q", pair[0], pair[1], old.String(), new.String())
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authors can edit their posts and replies. the version being replaced is
+// kept in post_revisions so the history page can show what changed
+
+var errNotPostAuthor = errors.New("you can only change your own posts")
+
+// one version of a post on the history page
+type PostRevision struct {
+	Content   string
+	WrittenAt string
+	Diff      []DiffPart // changes from the version before, nil for the original
+	Current   bool
+}
+
+type HistoryPageData struct {
+	Username  string
+	Post      *Post
+	Revisions []PostRevision // newest first, the current version included
+	TimeZone  *time.Location
+}
+
+// replaces the post's content, keeping the old version as a revision, and
+// its tags (see setPostTags). nil leaves either one as it is, and they
+// change together or not at all. sql.ErrNoRows if the post doesn't exist or
+// was deleted
+func editPost(postID int, username string, content *string, tags *[]string) error {
+	if content != nil {
+		if err := checkPostLength(*content); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var author, oldContent string
+	var parentID *int
+	err = tx.QueryRow("SELECT username, content, parent_id FROM posts WHERE id = ? AND deleted_at IS NULL", postID).Scan(&author, &oldContent, &parentID)
+	if err != nil {
+		return err
+	}
+	if author != username {
+		return errNotPostAuthor
+	}
+
+	newContent := oldContent
+	if content != nil && *content != oldContent {
+		newContent = *content
+		_, err = tx.Exec(`
+			INSERT INTO post_revisions (post_id, content, written_at)
+			SELECT id, content, COALESCE(edited_at, created_at) FROM posts WHERE id = ?
+		`, postID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE posts SET content = ?, content_html = ?, edited_at = CURRENT_TIMESTAMP WHERE id = ?", newContent, string(renderMarkdown(newContent)), postID)
+		if err != nil {
+			return err
+		}
+		if err := savePostRefs(tx, postID, newContent, canHaveTags(parentID)); err != nil {
+			return err
+		}
+	}
+
+	if tags != nil {
+		if err := setPostTags(tx, postID, parentID, newContent, *tags); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if tags != nil {
+		if _, err := cleanupUnusedTags(); err != nil {
+			log.Printf("Error cleaning up tags: %v", err)
+		}
+	}
+	return nil
+}
+
+// every version of the post with the diff from the one before, newest first
+func getPostRevisions(post *Post) ([]PostRevision, error) {
+	rows, err := db.Query(`
+		SELECT content, written_at
+		FROM post_revisions
+		WHERE post_id = ?
+		ORDER BY id ASC
+	`, post.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []PostRevision
+	for rows.Next() {
+		var revision PostRevision
+		if err := rows.Scan(&revision.Content, &revision.WrittenAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	current := PostRevision{Content: post.Content, WrittenAt: post.CreatedAt, Current: true}
+	if post.EditedAt != nil {
+		current.WrittenAt = *post.EditedAt
+	}
+	revisions = append(revisions, current)
+
+	for i := 1; i < len(revisions); i++ {
+		revisions[i].Diff = diffWords(revisions[i-1].Content, revisions[i].Content)
+	}
+	for i, j := 0, len(revisions)-1; i < j; i, j = i+1, j-1 {
+		revisions[i], revisions[j] = revisions[j], revisions[i]
+	}
+	return revisions, nil
+}
+
+// where to send someone after they've touched a post: the thread it's in
+func threadURL(post *Post) string {
+	if post.ParentID != nil {
+		return "/thread?id=" + strconv.Itoa(*post.ParentID)
+	}
+	return "/thread?id=" + strconv.Itoa(post.ID)
+}
+
+// edit page and form target, /edit?id=
+func editPostHandler(w http.ResponseWriter, r *http.Request) {
+	_, username, ok := getAuthUser(r, scopeWrite)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	postID, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid post ID", 400)
+		return
+	}
+
+	post, err := getPost(postID)
+	if err == sql.ErrNoRows || (err == nil && post.Deleted) {
+		http.Error(w, "Post not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if post.Username != username {
+		http.Error(w, errNotPostAuthor.Error(), http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "POST" {
+		templates.ExecuteTemplate(w, "edit.html", PageData{
+			Username:  username,
+			CSRFToken: csrfToken(w, r),
+			Post:      post,
+		})
+		return
+	}
+
+	content := r.FormValue("content")
+	if strings.TrimSpace(content) == "" {
+		http.Error(w, "Missing content", 400)
+		return
+	}
+	if err := checkPostLength(content); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	tags, err := normalizeTags(parseTags(r.FormValue("tags")))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// the form only has tags when the post can have them
+	var newTags *[]string
+	if post.Taggable() {
+		newTags = &tags
+	}
+	if err := editPost(postID, username, &content, newTags); err != nil {
+		var invalidTag invalidTagError
+		if err == errPostTooLong || errors.As(err, &invalidTag) {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		log.Printf("Error editing post %d: %v", postID, err)
+		http.Error(w, "Failed to edit post", 500)
+		return
+	}
+	http.Redirect(w, r, threadURL(post), http.StatusSeeOther)
+}
+
+// all versions of a post, /history?id=
+func postHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	postID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid post ID", 400)
+		return
+	}
+
+	post, err := getPost(postID)
+	if err == sql.ErrNoRows || (err == nil && post.Deleted) {
+		http.Error(w, "Post not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	revisions, err := getPostRevisions(post)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	templates.ExecuteTemplate(w, "history.html", HistoryPageData{
+		Username:  getUsername(r),
+		Post:      post,
+		Revisions: revisions,
+		TimeZone:  viewerLocation(r, time.UTC),
+	})
+}
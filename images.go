@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// uploaded images are never stored as-is. they're sniffed, size checked,
+// decoded and re-encoded, which also throws away EXIF/GPS metadata
+
+// biggest upload accepted, in MB (TERRACOTTA_MAX_UPLOAD_MB)
+var maxUploadBytes = int64(envInt("TERRACOTTA_MAX_UPLOAD_MB", 10)) << 20
+
+// longest side an image may have, in pixels (TERRACOTTA_MAX_IMAGE_DIMENSION)
+var maxImageDimension = envInt("TERRACOTTA_MAX_IMAGE_DIMENSION", 6000)
+
+// most frames an animated gif may have
+const maxGIFFrames = 1000
+
+var errNotAnImage = errors.New("unsupported image type, use jpeg, png, gif or webp")
+
+// an image upload rejected for being too big, the message is shown to the user
+type imageTooLargeError struct {
+	reason string
+}
+
+func (e imageTooLargeError) Error() string {
+	return e.reason
+}
+
+// status code and user facing message for an image that couldn't be saved
+func imageErrorStatus(err error) (int, string) {
+	var tooLarge imageTooLargeError
+	var tooLargeBody *http.MaxBytesError
+	var badAttachment attachmentError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, tooLarge.Error()
+	case errors.As(err, &tooLargeBody):
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("request is larger than %d MB", tooLargeBody.Limit>>20)
+	case errors.Is(err, errNotAnImage), errors.As(err, &badAttachment):
+		return http.StatusBadRequest, err.Error()
+	}
+	log.Printf("Error saving image: %v", err)
+	return http.StatusInternalServerError, "Failed to save image"
+}
+
+// an upload that passed validation, ready to be stored
+type processedImage struct {
+	data   []byte      // re-encoded file contents
+	ext    string      // extension that goes with data
+	img    image.Image // decoded image, nil for gifs which don't get resized
+	width  int
+	height int
+}
+
+// reads, validates and re-encodes an uploaded image
+func processImage(r io.Reader) (*processedImage, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxUploadBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxUploadBytes {
+		return nil, imageTooLargeError{fmt.Sprintf("image is larger than %d MB", maxUploadBytes>>20)}
+	}
+
+	// trust the bytes, not the client's Content-Type or file name
+	contentType := http.DetectContentType(data)
+	if !isValidImage(contentType) {
+		return nil, errNotAnImage
+	}
+
+	// check dimensions before decoding so a tiny file can't blow up into a
+	// huge bitmap in memory
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errNotAnImage
+	}
+	if cfg.Width > maxImageDimension || cfg.Height > maxImageDimension {
+		return nil, imageTooLargeError{fmt.Sprintf("image is larger than %dx%d pixels", maxImageDimension, maxImageDimension)}
+	}
+
+	if contentType == "image/gif" {
+		// every frame is decoded into its own bitmap, so an animation gets
+		// the pixels of one image of the biggest size, spread over its frames
+		frames, pixels, err := gifFrames(data)
+		if err != nil {
+			return nil, err
+		}
+		if frames > maxGIFFrames {
+			return nil, imageTooLargeError{fmt.Sprintf("animations can have at most %d frames", maxGIFFrames)}
+		}
+		if pixels > int64(maxImageDimension)*int64(maxImageDimension) {
+			return nil, imageTooLargeError{"animation is too large, use fewer or smaller frames"}
+		}
+
+		// keep animations, EncodeAll drops comments and other extensions
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, errNotAnImage
+		}
+		var out bytes.Buffer
+		if err := gif.EncodeAll(&out, g); err != nil {
+			return nil, err
+		}
+		return &processedImage{data: out.Bytes(), ext: ".gif", width: g.Config.Width, height: g.Config.Height}, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errNotAnImage
+	}
+
+	// jpegs stay jpegs. png stays png, and so does webp since there's no
+	// webp encoder in pure go
+	ext := ".png"
+	if contentType == "image/jpeg" {
+		ext = ".jpg"
+		// the orientation lives in the EXIF we're about to drop, so bake it in
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	encoded, err := encodeImage(img, ext)
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	return &processedImage{data: encoded, ext: ext, img: img, width: b.Dx(), height: b.Dy()}, nil
+}
+
+// counts a gif's frames and their pixels by walking its blocks, without
+// decoding any of them
+func gifFrames(data []byte) (frames int, pixels int64, err error) {
+	// header, then the logical screen descriptor and its color table
+	if len(data) < 13 {
+		return 0, 0, errNotAnImage
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&7 + 1)
+	}
+
+	// data sub-blocks, each with a length byte, ending at a 0 length
+	skipSubBlocks := func() {
+		for pos < len(data) {
+			n := int(data[pos])
+			pos += 1 + n
+			if n == 0 {
+				return
+			}
+		}
+	}
+
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension: label, then sub-blocks
+			pos += 2
+			skipSubBlocks()
+		case 0x2C: // image descriptor, a frame
+			if pos+10 > len(data) {
+				return frames, pixels, nil
+			}
+			width := binary.LittleEndian.Uint16(data[pos+5:])
+			height := binary.LittleEndian.Uint16(data[pos+7:])
+			packed := data[pos+9]
+			frames++
+			pixels += int64(width) * int64(height)
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 << (packed&7 + 1)
+			}
+			pos++ // lzw minimum code size
+			skipSubBlocks()
+		case 0x3B: // trailer
+			return frames, pixels, nil
+		default:
+			return 0, 0, errNotAnImage
+		}
+	}
+	// no trailer, the decoder decides whether that's ok
+	return frames, pixels, nil
+}
+
+func encodeImage(img image.Image, ext string) ([]byte, error) {
+	var out bytes.Buffer
+	var err error
+	if ext == ".jpg" {
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&out, img)
+	}
+	return out.Bytes(), err
+}
+
+// scales the image down to the given width, keeping the aspect ratio
+func resizeImage(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	height := max(1, b.Dy()*width/b.Dx())
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, xdraw.Src, nil)
+	return dst
+}
+
+// reads the EXIF orientation tag (1-8) out of a jpeg, 1 if there isn't one
+func jpegOrientation(data []byte) int {
+	// walk the segments until the APP1 one holding EXIF
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xDA || length < 2 || pos+2+length > len(data) { // start of scan, no more metadata
+			break
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+// finds tag 0x0112 in IFD0 of a TIFF blob
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// rotates/flips the image so it looks right without its EXIF orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// orientations 5-8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	src := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // upside down mirrored
+				dx, dy = x, h-1-y
+			case 5: // mirrored, rotated 90 ccw
+				dx, dy = y, x
+			case 6: // rotated 90 cw
+				dx, dy = h-1-y, x
+			case 7: // mirrored, rotated 90 cw
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 ccw
+				dx, dy = y, w-1-x
+			}
+			dst.SetNRGBA(dx, dy, src.NRGBAAt(x, y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testPNG(width, height int, noise bool) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	rng := rand.New(rand.NewSource(1))
+	for i := range img.Pix {
+		if noise {
+			img.Pix[i] = byte(rng.Intn(256))
+		} else {
+			img.Pix[i] = 0xff
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func testJPEG(width, height int) []byte {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil)
+	return buf.Bytes()
+}
+
+func testGIF(frames, width, height int) []byte {
+	g := &gif.GIF{}
+	for range frames {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.Black, color.White})
+		frame.Set(0, 0, color.White)
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, g)
+	return buf.Bytes()
+}
+
+func TestProcessImage(t *testing.T) {
+	defer func(bytes int64, dimension int) {
+		maxUploadBytes, maxImageDimension = bytes, dimension
+	}(maxUploadBytes, maxImageDimension)
+	maxUploadBytes = 64 << 10
+	maxImageDimension = 200
+
+	tests := []struct {
+		name     string
+		data     []byte
+		ext      string // on success
+		width    int
+		tooLarge string // part of the imageTooLargeError
+		notImage bool
+	}{
+		{name: "png", data: testPNG(120, 80, false), ext: ".png", width: 120},
+		{name: "jpeg", data: testJPEG(50, 50), ext: ".jpg", width: 50},
+		{name: "animated gif", data: testGIF(3, 40, 30), ext: ".gif", width: 40},
+		{name: "largest allowed", data: testPNG(200, 200, false), ext: ".png", width: 200},
+
+		{name: "too many bytes", data: testPNG(200, 200, true), tooLarge: "MB"},
+		{name: "too wide", data: testPNG(201, 1, false), tooLarge: "200x200 pixels"},
+		{name: "too tall", data: testJPEG(1, 201), tooLarge: "200x200 pixels"},
+		{name: "too many frames", data: testGIF(maxGIFFrames+1, 1, 1), tooLarge: "at most 1000 frames"},
+		// each frame fits, all of them together don't
+		{name: "too many gif pixels", data: testGIF(5, 200, 200), tooLarge: "animation is too large"},
+
+		{name: "text", data: []byte("hello, this is not an image"), notImage: true},
+		{name: "html", data: []byte("<html><script>alert(1)</script></html>"), notImage: true},
+		{name: "empty", data: nil, notImage: true},
+		{name: "truncated png", data: testPNG(10, 10, false)[:30], notImage: true},
+		// a 10x10 screen descriptor, then a block that isn't one
+		{name: "gif garbage", data: append([]byte("GIF89a\x0a\x00\x0a\x00\x00\x00\x00"), bytes.Repeat([]byte{0x55}, 40)...), notImage: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			processed, err := processImage(bytes.NewReader(test.data))
+
+			var tooLarge imageTooLargeError
+			switch {
+			case test.tooLarge != "":
+				if !errors.As(err, &tooLarge) || !strings.Contains(err.Error(), test.tooLarge) {
+					t.Errorf("err = %v, want an imageTooLargeError with %q", err, test.tooLarge)
+				}
+			case test.notImage:
+				if !errors.Is(err, errNotAnImage) {
+					t.Errorf("err = %v, want errNotAnImage", err)
+				}
+			case err != nil:
+				t.Errorf("err = %v", err)
+			case processed.ext != test.ext || processed.width != test.width:
+				t.Errorf("got %s %dpx wide, want %s %dpx", processed.ext, processed.width, test.ext, test.width)
+			default:
+				// what's stored is the re-encoded image, and it still decodes
+				if _, _, err := image.Decode(bytes.NewReader(processed.data)); err != nil {
+					t.Errorf("re-encoded image doesn't decode: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestImageErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{imageTooLargeError{"image is larger than 10 MB"}, 413},
+		{fmt.Errorf("reading upload: %w", &http.MaxBytesError{Limit: 41 << 20}), 413},
+		{errNotAnImage, 400},
+		{attachmentError{"invalid media id"}, 400},
+		{errors.New("disk full"), 500},
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, test := range tests {
+		if status, _ := imageErrorStatus(test.err); status != test.status {
+			t.Errorf("imageErrorStatus(%v) = %d, want %d", test.err, status, test.status)
+		}
+	}
+}
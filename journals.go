@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// journals are day-numbered feeds of journal posts. each one has its own
+// start date, and optionally an end date, so several cohorts can run their
+// own journals at the same time. day 1 is the start date
+
+// the journal /journal shows, and the one journal posts go to when they
+// don't say (TERRACOTTA_DEFAULT_JOURNAL). if there's no journal with that
+// slug, the one that started most recently is used
+var defaultJournalSlug = envString("TERRACOTTA_DEFAULT_JOURNAL", "neighborhood")
+
+const journalDateLayout = "2006-01-02"
+
+var (
+	errJournalNotFound   = errors.New("journal not found")
+	errJournalNotStarted = errors.New("this journal hasn't started yet")
+	errJournalEnded      = errors.New("this journal has ended")
+)
+
+type Journal struct {
+	ID        int     `json:"id"`
+	Slug      string  `json:"slug"`
+	Name      string  `json:"name"`
+	StartDate string  `json:"start_date"`         // YYYY-MM-DD
+	EndDate   *string `json:"end_date,omitempty"` // last day, nil if it doesn't end
+	TimeZone  string  `json:"time_zone"`          // where its days start and end
+	PostCount int     `json:"post_count"`
+}
+
+// where the journal's page lives
+func (j Journal) Path() string {
+	return "/journals/" + j.Slug
+}
+
+func (j Journal) Location() *time.Location {
+	return locationOrUTC(j.TimeZone)
+}
+
+// which day of the journal the date is, day 1 being the start date. dates
+// before the start are 0 or less. the date is taken in date's own zone
+func (j Journal) DayNumber(date time.Time) int {
+	start, err := time.Parse(journalDateLayout, j.StartDate)
+	if err != nil {
+		log.Printf("Error parsing start date of journal %s: %v", j.Slug, err)
+		return 0
+	}
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	return int(day.Sub(start).Round(time.Hour).Hours()/24) + 1
+}
+
+// nil if posts can be added on that date, otherwise why not
+func (j Journal) checkOpen(date time.Time) error {
+	day := date.Format(journalDateLayout)
+	if day < j.StartDate {
+		return errJournalNotStarted
+	}
+	if j.EndDate != nil && day > *j.EndDate {
+		return errJournalEnded
+	}
+	return nil
+}
+
+// whether posts can be added today in the journal's zone, for the templates
+func (j Journal) Open() bool {
+	return j.checkOpen(time.Now().In(j.Location())) == nil
+}
+
+type JournalPageData struct {
+	Username   string         `json:"username"`
+	CSRFToken  string         `json:"-"`
+	Journal    Journal        `json:"journal"`
+	Journals   []Journal      `json:"-"` // to switch between them
+	DayGroups  []DayGroup     `json:"day_groups"`
+	Pagination *Pagination    `json:"pagination,omitempty"`
+	TimeZone   *time.Location `json:"-"` // timestamps are shown in it
+}
+
+const journalColumns = `
+	journals.id, journals.slug, journals.name, journals.start_date, journals.end_date, journals.time_zone,
+	(SELECT COUNT(*) FROM posts WHERE posts.journal_id = journals.id AND posts.parent_id IS NULL AND posts.deleted_at IS NULL)
+`
+
+func scanJournal(row interface{ Scan(...any) error }) (Journal, error) {
+	var j Journal
+	err := row.Scan(&j.ID, &j.Slug, &j.Name, &j.StartDate, &j.EndDate, &j.TimeZone, &j.PostCount)
+	return j, err
+}
+
+// all journals, the most recently started first
+func getJournals() ([]Journal, error) {
+	rows, err := db.Query("SELECT " + journalColumns + " FROM journals ORDER BY start_date DESC, id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var journals []Journal
+	for rows.Next() {
+		j, err := scanJournal(rows)
+		if err != nil {
+			return nil, err
+		}
+		journals = append(journals, j)
+	}
+	return journals, rows.Err()
+}
+
+// the journal with that slug, or the default journal for "".
+// errJournalNotFound if there isn't one
+func getJournal(slug string) (Journal, error) {
+	var row *sql.Row
+	if slug == "" {
+		// see defaultJournalSlug
+		row = db.QueryRow("SELECT "+journalColumns+" FROM journals ORDER BY slug = ? DESC, start_date DESC, id DESC LIMIT 1", defaultJournalSlug)
+	} else {
+		row = db.QueryRow("SELECT "+journalColumns+" FROM journals WHERE slug = ?", slug)
+	}
+	j, err := scanJournal(row)
+	if err == sql.ErrNoRows {
+		return j, errJournalNotFound
+	}
+	return j, err
+}
+
+// the journal a journal post is in, sql.ErrNoRows if it isn't in one
+func getPostJournal(postID int) (Journal, error) {
+	return scanJournal(db.QueryRow("SELECT "+journalColumns+" FROM journals WHERE id = (SELECT journal_id FROM posts WHERE id = ?)", postID))
+}
+
+// the journal username's new journal post goes to (see getJournal), or an
+// error saying why it can't go there. whether it's open is up to the date
+// where they are
+func openJournal(slug, username string) (Journal, error) {
+	j, err := getJournal(slug)
+	if err != nil {
+		return j, err
+	}
+	return j, j.checkOpen(time.Now().In(userLocation(username, j.Location())))
+}
+
+// http status for an error from openJournal
+func journalErrorStatus(err error) int {
+	switch err {
+	case errJournalNotFound:
+		return http.StatusNotFound
+	case errJournalNotStarted, errJournalEnded:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// a page of the journal's top-level posts, newest first
+func getJournalPosts(journal Journal, page PageRequest) ([]Post, Pagination, error) {
+	return getFeedPosts("posts.post_type = 'journal' AND posts.journal_id = ?", page, journal.ID)
+}
+
+// /journal for the default journal, /journals/{slug} for the others
+func journalHandler(w http.ResponseWriter, r *http.Request) {
+	journal, err := getJournal(r.PathValue("slug"))
+	if err == errJournalNotFound {
+		http.Error(w, "Journal not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	posts, pagination, err := getJournalPosts(journal, pageRequestFromQuery(r))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	journals, err := getJournals()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	data := JournalPageData{
+		Username:   getUsername(r),
+		CSRFToken:  csrfToken(w, r),
+		Journal:    journal,
+		Journals:   journals,
+		DayGroups:  groupPostsByDayFixed(journal, posts),
+		Pagination: &pagination,
+		TimeZone:   viewerLocation(r, journal.Location()),
+	}
+	templates.ExecuteTemplate(w, "journal.html", data)
+}
+
+// slugs follow the tag rules, but have to be typed already normalized
+func validateJournalSlug(slug string) error {
+	normalized, err := normalizeTag(slug)
+	if err != nil || normalized != slug {
+		return fmt.Errorf("invalid journal slug %q: use lowercase letters, numbers, - and _", slug)
+	}
+	return nil
+}
+
+func validateJournalDate(date string) error {
+	if _, err := time.Parse(journalDateLayout, date); err != nil {
+		return fmt.Errorf("invalid date %q: use YYYY-MM-DD", date)
+	}
+	return nil
+}
+
+func createJournal(slug, name, startDate string, endDate *string) error {
+	if err := validateJournalSlug(slug); err != nil {
+		return err
+	}
+	if strings.TrimSpace(name) == "" {
+		return errors.New("a journal needs a name")
+	}
+	if err := validateJournalDate(startDate); err != nil {
+		return err
+	}
+	if endDate != nil {
+		if err := validateJournalDate(*endDate); err != nil {
+			return err
+		}
+		if *endDate < startDate {
+			return errors.New("a journal can't end before it starts")
+		}
+	}
+	_, err := db.Exec("INSERT INTO journals (slug, name, start_date, end_date) VALUES (?, ?, ?, ?)", slug, name, startDate, endDate)
+	return err
+}
+
+// sets the zone the journal's days start and end in
+func setJournalTimeZone(slug, zone string) error {
+	j, err := getJournal(slug)
+	if err != nil {
+		return err
+	}
+	if _, err := loadLocation(zone); err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE journals SET time_zone = ? WHERE id = ?", zone, j.ID)
+	return err
+}
+
+// sets the last day of the journal, nil for no end
+func setJournalEnd(slug string, endDate *string) error {
+	j, err := getJournal(slug)
+	if err != nil {
+		return err
+	}
+	if endDate != nil {
+		if err := validateJournalDate(*endDate); err != nil {
+			return err
+		}
+		if *endDate < j.StartDate {
+			return errors.New("a journal can't end before it starts")
+		}
+	}
+	_, err = db.Exec("UPDATE journals SET end_date = ? WHERE id = ?", endDate, j.ID)
+	return err
+}
+
+// `terracotta journals ...`
+func runJournalsCommand(args []string) {
+	usage := "usage: terracotta journals list | create <slug> <name> <start> [end] | end <slug> <date> | reopen <slug> | timezone <slug> <zone>"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		var journals []Journal
+		if journals, err = getJournals(); err == nil {
+			for _, j := range journals {
+				end := "-"
+				if j.EndDate != nil {
+					end = *j.EndDate
+				}
+				fmt.Printf("%-20s %s to %-10s %-20s %5d posts  %s\n", j.Slug, j.StartDate, end, j.TimeZone, j.PostCount, j.Name)
+			}
+		}
+	case args[0] == "create" && (len(args) == 4 || len(args) == 5):
+		var endDate *string
+		if len(args) == 5 {
+			endDate = &args[4]
+		}
+		err = createJournal(args[1], args[2], args[3], endDate)
+	case args[0] == "end" && len(args) == 3:
+		err = setJournalEnd(args[1], &args[2])
+	case args[0] == "reopen" && len(args) == 2:
+		err = setJournalEnd(args[1], nil)
+	case args[0] == "timezone" && len(args) == 3:
+		err = setJournalTimeZone(args[1], args[2])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
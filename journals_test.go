@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJournalDayNumber(t *testing.T) {
+	journal := Journal{Slug: "test", StartDate: "2026-03-01"}
+	la, _ := time.LoadLocation("America/Los_Angeles")
+	kiritimati, _ := time.LoadLocation("Pacific/Kiritimati") // UTC+14
+	pagoPago, _ := time.LoadLocation("Pacific/Pago_Pago")    // UTC-11
+
+	tests := []struct {
+		date time.Time
+		want int
+	}{
+		{time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), 1},
+		{time.Date(2026, 3, 1, 23, 59, 59, 0, time.UTC), 1},
+		{time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), 2},
+		{time.Date(2026, 2, 28, 23, 59, 0, 0, time.UTC), 0},
+		{time.Date(2026, 2, 1, 12, 0, 0, 0, time.UTC), -27},
+		{time.Date(2027, 3, 1, 12, 0, 0, 0, time.UTC), 366},
+
+		// the date is the one in the time's own zone
+		{time.Date(2026, 3, 1, 23, 30, 0, 0, time.UTC).In(kiritimati), 2},
+		{time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC).In(pagoPago), 0},
+		{time.Date(2026, 3, 1, 23, 0, 0, 0, la), 1},
+		// days across the switch to daylight saving time (march 8 in LA)
+		// are still whole days
+		{time.Date(2026, 3, 8, 1, 0, 0, 0, la), 8},
+		{time.Date(2026, 3, 8, 23, 0, 0, 0, la), 8},
+		{time.Date(2026, 3, 9, 0, 30, 0, 0, la), 9},
+		{time.Date(2026, 11, 1, 23, 0, 0, 0, la), 246},
+	}
+	for _, test := range tests {
+		if got := journal.DayNumber(test.date); got != test.want {
+			t.Errorf("DayNumber(%v) = %d, want %d", test.date, got, test.want)
+		}
+	}
+
+	broken := Journal{Slug: "broken", StartDate: "soon"}
+	if got := broken.DayNumber(time.Now()); got != 0 {
+		t.Errorf("DayNumber with a bad start date = %d, want 0", got)
+	}
+}
@@ -5,12 +5,12 @@ import (
 	"html/template"
 	"log"
 	"net/http"
-	"strings"
+	"os"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 var db *sql.DB
-var templates = template.Must(template.ParseGlob("templates/*.html"))
+var templates = template.Must(template.New("").Funcs(templateFuncs).ParseGlob("templates/*.html"))
 
 func main() {
 	var err error
@@ -20,113 +20,81 @@ func main() {
 	}
 	defer db.Close()
 
-
-	initDatabase()
-
-	//routes
-	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/thread", postThreadHandler)
-	http.HandleFunc("/post", postHandler)
-	http.HandleFunc("/journal", journalHandler)
-	http.HandleFunc("/journal/post", journalPostHandler)
-	http.HandleFunc("/like", likePostHandler)
-	http.HandleFunc("/register", registerHandler)
-	http.HandleFunc("/login", loginHandler)
-	http.HandleFunc("/logout", logoutHandler)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-
-	log.Println("Starting server on :8081...")
-	log.Fatal(http.ListenAndServe(":8081", nil))
-
-	migrateDatabase()
-}
-
-func initDatabase() {
-	// user table
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL
-		);
-	`)
-	if err != nil {
-		log.Fatal(err)
+	// `terracotta migrate ...` manages the schema without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
 	}
 
-	// posts table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS posts (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT NOT NULL,
-			content TEXT NOT NULL,
-			parent_id INTEGER,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (parent_id) REFERENCES posts(id)
-		);
-	`)
-	if err != nil {
+	if err := migrateUp(); err != nil {
 		log.Fatal(err)
 	}
 
-	// Add post_type column if it doesn't exist (ignore error if it already exists)
-	_, err = db.Exec(`ALTER TABLE posts ADD COLUMN post_type TEXT DEFAULT 'regular'`)
-	if err != nil {
-		// Log the error but don't fail - column might already exist
-		log.Println("Note: post_type column might already exist:", err)
+	// `terracotta tags ...` merges and aliases tags
+	if len(os.Args) > 1 && os.Args[1] == "tags" {
+		runTagsCommand(os.Args[2:])
+		return
 	}
 
-	//create likes table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS likes (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			post_id INTEGER NOT NULL,
-			FOREIGN KEY (user_id) REFERENCES users(id),
-			FOREIGN KEY (post_id) REFERENCES posts(id),
-			UNIQUE (user_id, post_id)
-		);
-	`)
-	if err != nil {
-		log.Fatal(err)
+	// `terracotta journals ...` creates and ends journals
+	if len(os.Args) > 1 && os.Args[1] == "journals" {
+		runJournalsCommand(os.Args[2:])
+		return
 	}
+	purgeExpiredSessions()
 
-	// tags table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS tags (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT UNIQUE NOT NULL
-		);
-	`)
+	mediaStore, err = newMediaStore()
 	if err != nil {
 		log.Fatal(err)
 	}
+	startUploadGC()
+	startDeletedPostPurge()
+	startTrendingWorker()
 
-	//post_tags junction
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS post_tags (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			post_id INTEGER NOT NULL,
-			tag_id INTEGER NOT NULL,
-			FOREIGN KEY (post_id) REFERENCES posts(id),
-			FOREIGN KEY (tag_id) REFERENCES tags(id),
-			UNIQUE (post_id, tag_id)
-		);
-	`)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
+	//routes
+	http.HandleFunc("/", indexHandler)
+	http.HandleFunc("/thread", postThreadHandler)
+	http.HandleFunc("/post", postHandler)
+	http.HandleFunc("/journal", journalHandler)
+	http.HandleFunc("GET /journals/{slug}", journalHandler)
+	http.HandleFunc("/settings", settingsHandler)
+	http.HandleFunc("/journal/post", journalPostHandler)
+	http.HandleFunc("/like", likePostHandler)
+	http.HandleFunc("/edit", editPostHandler)
+	http.HandleFunc("/history", postHistoryHandler)
+	http.HandleFunc("/delete", deletePostHandler)
+	http.HandleFunc("GET /user/{name}", userHandler)
+	http.HandleFunc("GET /tag/{name}", tagHandler)
+	http.HandleFunc("GET /tags", tagIndexHandler)
+	http.HandleFunc("/register", registerHandler)
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/sessions", sessionsHandler)
+	http.HandleFunc("/sessions/revoke", revokeSessionHandler)
+	http.HandleFunc("/sessions/revoke-all", revokeAllSessionsHandler)
+	http.HandleFunc("/tokens", tokensHandler)
+	http.HandleFunc("/tokens/revoke", revokeTokenHandler)
+
+	// json api
+	http.HandleFunc("GET /api/v1/timeline", apiTimelineHandler)
+	http.HandleFunc("GET /api/v1/posts/{id}", apiThreadHandler)
+	http.HandleFunc("POST /api/v1/posts", apiCreatePostHandler)
+	http.HandleFunc("PATCH /api/v1/posts/{id}", apiEditPostHandler)
+	http.HandleFunc("DELETE /api/v1/posts/{id}", apiDeletePostHandler)
+	http.HandleFunc("POST /api/v1/media", UploadImageHandler)
+	http.HandleFunc("POST /api/v1/preview", apiPreviewHandler)
+	http.HandleFunc("POST /api/v1/posts/{id}/like", apiLikeHandler)
+	http.HandleFunc("GET /api/v1/tags", apiTagsHandler)
+	http.HandleFunc("GET /api/v1/tags/{name}", apiTagHandler)
+	http.HandleFunc("GET /api/v1/trending", apiTrendingHandler)
+	http.HandleFunc("GET /api/v1/journal", apiJournalHandler)
+	http.HandleFunc("GET /api/v1/journals", apiJournalsHandler)
+	http.HandleFunc("GET /api/v1/journals/{slug}", apiJournalHandler)
+	http.HandleFunc("/api/", apiNotFoundHandler)
 
-// this is mostly bc im lazy
-func migrateDatabase(){
-	var count int
-	err := db.QueryRow("PRAGMA table_info(posts)").Scan(&count)
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	http.HandleFunc("/uploads/", uploadsHandler)
 
-	_, err = db.Exec("ALTER TABLE posts ADD COLUMN image_url TEXT")
-	if err != nil {
-		if !strings.Contains(err.Error(), "duplicate column name: image_url") {
-			log.Printf("Warning: Could not add image_url column: %v", err)
-		}
-	}
+	log.Println("Starting server on :8081...")
+	log.Fatal(http.ListenAndServe(":8081", limitRequestBody(csrfMiddleware(http.DefaultServeMux))))
 }
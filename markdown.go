@@ -0,0 +1,654 @@
+package main
+
+import (
+	"database/sql"
+	"html"
+	"html/template"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// post content is written in a small subset of markdown: paragraphs with
+// hard line breaks, fenced code blocks, blockquotes, lists, and inline
+// emphasis, code and links. @mentions, #hashtags and bare urls are linked
+// too. there are no headings, a line starting with # is a hashtag. raw html
+// in the source is always escaped, and the rendered html goes through
+// sanitizeHTML before it reaches a template
+
+// how deep blockquotes, lists, emphasis and links can nest before the
+// rest is plain text
+const maxMarkdownDepth = 8
+
+// longest url that gets linked
+const maxURLLength = 2048
+
+var (
+	fencePattern    = regexp.MustCompile("^ {0,3}(```+|~~~+)")
+	quotePattern    = regexp.MustCompile(`^ {0,3}> ?`)
+	listItemPattern = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])( +|$)`)
+)
+
+// renders post content to html that's safe to put on the page
+func renderMarkdown(src string) template.HTML {
+	return template.HTML(sanitizeHTML(renderBlocks(splitLines(src), 0, nil)))
+}
+
+func splitLines(src string) []string {
+	return strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+}
+
+// the post content as html, for the templates. it's rendered when the post
+// is written, posts from before that are rendered here
+func (p Post) ContentHTML() template.HTML {
+	if p.contentHTML != "" {
+		return template.HTML(p.contentHTML)
+	}
+	return renderMarkdown(p.Content)
+}
+
+// renders every post's stored html again, for migrations that change how
+// posts render
+func rerenderPosts(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, content FROM posts")
+	if err != nil {
+		return err
+	}
+	rendered := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var content string
+		if err := rows.Scan(&id, &content); err != nil {
+			rows.Close()
+			return err
+		}
+		rendered[id] = string(renderMarkdown(content))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, html := range rendered {
+		if _, err := tx.Exec("UPDATE posts SET content_html = ? WHERE id = ?", html, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refs collects the mentions and hashtags that get linked, it can be nil
+func renderBlocks(lines []string, depth int, refs *contentRefs) string {
+	var out strings.Builder
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case fencePattern.MatchString(line):
+			fence := strings.TrimLeft(fencePattern.FindStringSubmatch(line)[1], " ")
+			i++
+			var code []string
+			for i < len(lines) && !strings.HasPrefix(strings.TrimLeft(lines[i], " "), fence) {
+				code = append(code, lines[i])
+				i++
+			}
+			i++ // closing fence, if there is one
+			out.WriteString("<pre><code>")
+			out.WriteString(template.HTMLEscapeString(strings.Join(code, "\n")))
+			out.WriteString("</code></pre>\n")
+
+		case depth < maxMarkdownDepth && quotePattern.MatchString(line):
+			var quoted []string
+			for i < len(lines) && quotePattern.MatchString(lines[i]) {
+				quoted = append(quoted, quotePattern.ReplaceAllString(lines[i], ""))
+				i++
+			}
+			out.WriteString("<blockquote>\n")
+			out.WriteString(renderBlocks(quoted, depth+1, refs))
+			out.WriteString("</blockquote>\n")
+
+		case depth < maxMarkdownDepth && listItemPattern.MatchString(line):
+			i = renderList(&out, lines, i, depth, refs)
+
+		default:
+			i = renderParagraph(&out, lines, i, refs)
+		}
+	}
+	return out.String()
+}
+
+// starts another block, so it ends a paragraph
+func startsBlock(line string) bool {
+	return strings.TrimSpace(line) == "" || fencePattern.MatchString(line) ||
+		quotePattern.MatchString(line) || listItemPattern.MatchString(line)
+}
+
+// writes the paragraph starting at lines[i] and returns where it ended.
+// the first line is always taken, past maxMarkdownDepth it can look like a
+// quote or list
+func renderParagraph(out *strings.Builder, lines []string, i int, refs *contentRefs) int {
+	start := i
+	i++
+	for i < len(lines) && !startsBlock(lines[i]) {
+		i++
+	}
+	text := strings.TrimSpace(strings.Join(lines[start:i], "\n"))
+	out.WriteString("<p>")
+	out.WriteString(renderInline(text, true, 0, refs))
+	out.WriteString("</p>\n")
+	return i
+}
+
+// writes the list starting at lines[i] and returns where it ended. an item
+// runs until the next item, or a blank line followed by something that
+// isn't indented
+func renderList(out *strings.Builder, lines []string, i, depth int, refs *contentRefs) int {
+	first := listItemPattern.FindStringSubmatch(lines[i])
+	ordered := first[2][0] >= '0' && first[2][0] <= '9'
+
+	var items [][]string
+	for i < len(lines) {
+		// items can have blank lines between them
+		if len(items) > 0 && strings.TrimSpace(lines[i]) == "" && i+1 < len(lines) && listItemPattern.MatchString(lines[i+1]) {
+			i++
+		}
+		m := listItemPattern.FindStringSubmatch(lines[i])
+		if m == nil {
+			break
+		}
+		isOrdered := m[2][0] >= '0' && m[2][0] <= '9'
+		if isOrdered != ordered {
+			break
+		}
+		indent := len(m[0])
+		item := []string{lines[i][indent:]}
+		i++
+
+		for i < len(lines) {
+			line := lines[i]
+			if strings.TrimSpace(line) == "" {
+				// a blank line only continues the item if indented text follows
+				if i+1 < len(lines) && strings.HasPrefix(lines[i+1], strings.Repeat(" ", max(indent, 2))) {
+					item = append(item, "")
+					i++
+					continue
+				}
+				break
+			}
+			if listItemPattern.MatchString(line) && !strings.HasPrefix(line, strings.Repeat(" ", max(indent, 2))) {
+				break
+			}
+			item = append(item, strings.TrimPrefix(line, strings.Repeat(" ", indent)))
+			i++
+		}
+		items = append(items, item)
+	}
+
+	if ordered {
+		start, _ := strconv.Atoi(strings.TrimRight(first[2], ".)"))
+		if start != 1 {
+			out.WriteString(`<ol start="` + strconv.Itoa(start) + `">` + "\n")
+		} else {
+			out.WriteString("<ol>\n")
+		}
+	} else {
+		out.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		body := renderBlocks(item, depth+1, refs)
+		// an item that's just one paragraph doesn't need the <p>
+		if strings.Count(body, "<p>") == 1 && strings.HasPrefix(body, "<p>") {
+			body = strings.Replace(body, "<p>", "", 1)
+			body = strings.Replace(body, "</p>\n", "", 1)
+		}
+		out.WriteString("<li>" + strings.TrimSuffix(body, "\n") + "</li>\n")
+	}
+	if ordered {
+		out.WriteString("</ol>\n")
+	} else {
+		out.WriteString("</ul>\n")
+	}
+	return i
+}
+
+// renders emphasis, code spans, links, mentions, hashtags and line breaks.
+// links can't nest, so link text is rendered with links off. depth is how
+// many emphasis spans or links this is inside, past maxMarkdownDepth their
+// delimiters are plain text
+func renderInline(text string, links bool, depth int, refs *contentRefs) string {
+	scan := newInlineScan(text)
+	var out strings.Builder
+	plain := 0 // start of the text not written yet
+	flush := func(end int) {
+		out.WriteString(template.HTMLEscapeString(text[plain:end]))
+	}
+
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text) && isASCIIPunct(text[i+1]):
+			flush(i)
+			out.WriteString(template.HTMLEscapeString(text[i+1 : i+2]))
+			i += 2
+			plain = i
+			continue
+
+		case c == '\n':
+			flush(i)
+			out.WriteString("<br>\n")
+			i++
+			plain = i
+			continue
+
+		case c == '`':
+			run := countRun(text, i, '`')
+			closing := scan.codeSpanEnd(i+run, run)
+			if closing < 0 {
+				i += run
+				continue
+			}
+			flush(i)
+			code := text[i+run : closing]
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+				code = code[1 : len(code)-1]
+			}
+			out.WriteString("<code>" + template.HTMLEscapeString(code) + "</code>")
+			i = closing + run
+			plain = i
+			continue
+
+		case c == '[' && links && depth < maxMarkdownDepth:
+			if label, href, end, ok := scan.parseLink(i); ok {
+				flush(i)
+				out.WriteString(`<a href="` + template.HTMLEscapeString(href) + `">`)
+				out.WriteString(renderInline(label, false, depth+1, refs))
+				out.WriteString("</a>")
+				i = end
+				plain = i
+				continue
+			}
+
+		case c == '<' && links:
+			if end := scan.next('>', i); end < len(text) && end-i <= maxURLLength {
+				href := text[i+1 : end]
+				if strings.Contains(href, "://") && !strings.ContainsAny(href, " \n<") && safeURL(href) {
+					flush(i)
+					out.WriteString(`<a href="` + template.HTMLEscapeString(href) + `">`)
+					out.WriteString(template.HTMLEscapeString(href) + "</a>")
+					i = end + 1
+					plain = i
+					continue
+				}
+			}
+
+		case c == '@' && links && (i == 0 || !isWordChar(text[i-1])):
+			if name := scanMention(text[i+1:]); name != "" {
+				flush(i)
+				out.WriteString(`<a class="mention" href="/user/` + template.HTMLEscapeString(url.PathEscape(name)) + `">@`)
+				out.WriteString(template.HTMLEscapeString(name) + "</a>")
+				refs.addMention(name)
+				i += 1 + len(name)
+				plain = i
+				continue
+			}
+
+		case c == '#' && links && (i == 0 || !isWordChar(text[i-1])):
+			if name := scanHashtag(text[i+1:]); name != "" {
+				flush(i)
+				out.WriteString(`<a class="hashtag" href="/tag/` + template.HTMLEscapeString(url.PathEscape(name)) + `">#`)
+				out.WriteString(template.HTMLEscapeString(name) + "</a>")
+				refs.addHashtag(name)
+				i += 1 + len(name)
+				plain = i
+				continue
+			}
+
+		case c == 'h' && links && (i == 0 || !isWordChar(text[i-1])):
+			if href := scanURL(text[i:]); href != "" {
+				flush(i)
+				out.WriteString(`<a href="` + template.HTMLEscapeString(href) + `">`)
+				out.WriteString(template.HTMLEscapeString(href) + "</a>")
+				i += len(href)
+				plain = i
+				continue
+			}
+
+		case (c == '*' || c == '_') && depth < maxMarkdownDepth:
+			run := countRun(text, i, c)
+			size := min(run, 2)
+			if inner, end, ok := scan.parseEmphasis(i, size); ok {
+				flush(i)
+				tag := "em"
+				if size == 2 {
+					tag = "strong"
+				}
+				out.WriteString("<" + tag + ">" + renderInline(inner, links, depth+1, refs) + "</" + tag + ">")
+				i = end
+				plain = i
+				continue
+			}
+			i += run
+			continue
+		}
+		i++
+	}
+	flush(len(text))
+	return out.String()
+}
+
+// what renderInline needs to know about the text ahead of where it is,
+// worked out in one pass, so that no [, *, _ or ` has to scan the rest of
+// the text on its own. otherwise a post full of them takes quadratic time
+type inlineScan struct {
+	text string
+	// starts of the runs of backticks, by run length
+	backtickRuns map[int][]int
+	// index of the ] closing the [ at each index, -1 if it isn't closed
+	closeBracket []int
+	// index of the next ) and > at or after each index, len(text) if none
+	nextParen, nextAngle []int
+	// emphasis known to have no closer from that index on, by delimiter
+	// (* or _) and size
+	noCloserFrom [2][2]int
+}
+
+func newInlineScan(text string) *inlineScan {
+	scan := &inlineScan{
+		text:         text,
+		backtickRuns: make(map[int][]int),
+		closeBracket: make([]int, len(text)),
+		nextParen:    make([]int, len(text)+1),
+		nextAngle:    make([]int, len(text)+1),
+	}
+	for i := range scan.noCloserFrom {
+		scan.noCloserFrom[i] = [2]int{len(text), len(text)}
+	}
+
+	var open []int // unclosed [s
+	for i := 0; i < len(text); i++ {
+		scan.closeBracket[i] = -1
+		switch text[i] {
+		case '\\':
+			if i+1 < len(text) {
+				scan.closeBracket[i+1] = -1
+			}
+			i++
+		case '[':
+			open = append(open, i)
+		case ']':
+			if n := len(open); n > 0 {
+				scan.closeBracket[open[n-1]] = i
+				open = open[:n-1]
+			}
+		}
+	}
+
+	// backslashes don't escape anything inside code spans, so they don't
+	// matter for where one ends
+	for i := 0; i < len(text); i++ {
+		if text[i] == '`' {
+			run := countRun(text, i, '`')
+			scan.backtickRuns[run] = append(scan.backtickRuns[run], i)
+			i += run - 1
+		}
+	}
+
+	scan.nextParen[len(text)] = len(text)
+	scan.nextAngle[len(text)] = len(text)
+	for i := len(text) - 1; i >= 0; i-- {
+		scan.nextParen[i], scan.nextAngle[i] = scan.nextParen[i+1], scan.nextAngle[i+1]
+		switch text[i] {
+		case ')':
+			scan.nextParen[i] = i
+		case '>':
+			scan.nextAngle[i] = i
+		}
+	}
+	return scan
+}
+
+// index of the next ) or > at or after from, len(text) if there isn't one
+func (scan *inlineScan) next(c byte, from int) int {
+	if from > len(scan.text) {
+		return len(scan.text)
+	}
+	if c == ')' {
+		return scan.nextParen[from]
+	}
+	return scan.nextAngle[from]
+}
+
+// where the code span opened by a run of backticks ends: the next run of
+// exactly the same length at or after from. -1 if there isn't one
+func (scan *inlineScan) codeSpanEnd(from, run int) int {
+	starts := scan.backtickRuns[run]
+	if k := sort.SearchInts(starts, from); k < len(starts) {
+		return starts[k]
+	}
+	return -1
+}
+
+// [label](url) starting at text[i]. returns the label, the url, and the
+// index just after the link
+func (scan *inlineScan) parseLink(i int) (label, href string, end int, ok bool) {
+	text := scan.text
+	j := scan.closeBracket[i]
+	if j < 0 || j+1 >= len(text) || text[j+1] != '(' {
+		return "", "", 0, false
+	}
+	closing := scan.next(')', j+2)
+	if closing == len(text) {
+		return "", "", 0, false
+	}
+	href = strings.TrimSpace(text[j+2 : closing])
+	if href == "" || strings.ContainsAny(href, " \n") || !safeURL(href) {
+		return "", "", 0, false
+	}
+	return text[i+1 : j], href, closing + 1, true
+}
+
+// *text*, _text_, **text** or __text__ starting at text[i] with a
+// delimiter of size 1 or 2. like commonmark, the delimiters have to hug
+// the text, and _ doesn't work inside words so snake_case stays as it is
+func (scan *inlineScan) parseEmphasis(i, size int) (inner string, end int, ok bool) {
+	text := scan.text
+	c := text[i]
+	open := i + size
+	if open >= len(text) || isSpace(text[open]) {
+		return "", 0, false
+	}
+	if c == '_' && i > 0 && isWordChar(text[i-1]) {
+		return "", 0, false
+	}
+
+	// a closer is found the same way from anywhere, so once a search from
+	// here fails every later one for this delimiter would too
+	kind := 0
+	if c == '_' {
+		kind = 1
+	}
+	if open >= scan.noCloserFrom[kind][size-1] {
+		return "", 0, false
+	}
+
+	for j := open; j+size <= len(text); j++ {
+		if j == open && text[j] == c {
+			// can't close with nothing inside
+			continue
+		}
+		if text[j] == '\\' {
+			j++
+			continue
+		}
+		if text[j] == '`' {
+			// delimiters inside code spans don't count
+			run := countRun(text, j, '`')
+			if closing := scan.codeSpanEnd(j+run, run); closing >= 0 {
+				j = closing + run - 1
+			} else {
+				j += run - 1
+			}
+			continue
+		}
+		if text[j] != c {
+			continue
+		}
+		// a run of another size can't close this one, so *a **b** c* is
+		// one em with a strong inside
+		run := countRun(text, j, c)
+		if run < size || (size == 1 && run > 1) || isSpace(text[j-1]) {
+			j += run - 1
+			continue
+		}
+		// ***a*** closes on the last two, leaving *a* inside
+		j += run - size
+		after := j + size
+		if c == '_' && after < len(text) && isWordChar(text[after]) {
+			continue
+		}
+		return text[open:j], after, true
+	}
+	scan.noCloserFrom[kind][size-1] = open
+	return "", 0, false
+}
+
+func countRun(text string, i int, c byte) int {
+	n := 0
+	for i+n < len(text) && text[i+n] == c {
+		n++
+	}
+	return n
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isASCIIPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+// links can only go to the web, to email addresses, or to a path on the
+// site. browsers drop tabs and newlines from urls and read \ as /, so a
+// path has to start with exactly one / and nothing that turns it into //
+func safeURL(href string) bool {
+	href = strings.NewReplacer("\t", "", "\n", "", "\r", "").Replace(href)
+	u, err := url.Parse(href)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https", "mailto":
+		return true
+	case "":
+		return href == "/" || strings.HasPrefix(href, "/") && href[1] != '/' && href[1] != '\\'
+	}
+	return false
+}
+
+// sanitizing
+
+// tags the renderer can produce and the attributes each may keep
+var allowedTags = map[string][]string{
+	"p":          nil,
+	"br":         nil,
+	"em":         nil,
+	"strong":     nil,
+	"code":       nil,
+	"pre":        nil,
+	"blockquote": nil,
+	"ul":         nil,
+	"ol":         {"start"},
+	"li":         nil,
+	"a":          {"href", "class"},
+}
+
+var (
+	htmlTagPattern  = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9]*)((?:\s+[a-zA-Z-]+="[^"<>]*")*)\s*/?>`)
+	htmlAttrPattern = regexp.MustCompile(`([a-zA-Z-]+)="([^"]*)"`)
+)
+
+// keeps only allowlisted tags and attributes, escapes everything else, and
+// closes whatever is left open. the renderer escapes raw html on its own,
+// this makes sure nothing it gets wrong can reach the page
+func sanitizeHTML(src string) string {
+	var out strings.Builder
+	var open []string
+
+	writeText := func(text string) {
+		text = strings.ReplaceAll(text, "<", "&lt;")
+		out.WriteString(strings.ReplaceAll(text, ">", "&gt;"))
+	}
+
+	last := 0
+	for _, m := range htmlTagPattern.FindAllStringSubmatchIndex(src, -1) {
+		writeText(src[last:m[0]])
+		last = m[1]
+
+		closing := m[3] > m[2]
+		name := strings.ToLower(src[m[4]:m[5]])
+		allowed, ok := allowedTags[name]
+		if !ok {
+			writeText(src[m[0]:m[1]])
+			continue
+		}
+
+		if closing {
+			// only close the innermost open tag, anything else is dropped
+			if n := len(open); n > 0 && open[n-1] == name {
+				open = open[:n-1]
+				out.WriteString("</" + name + ">")
+			}
+			continue
+		}
+
+		out.WriteString("<" + name)
+		external := false
+		for _, attr := range htmlAttrPattern.FindAllStringSubmatch(src[m[6]:m[7]], -1) {
+			key, value := strings.ToLower(attr[1]), attr[2]
+			if !slices.Contains(allowed, key) || !safeAttr(name, key, value) {
+				continue
+			}
+			out.WriteString(" " + key + `="` + value + `"`)
+			if key == "href" && strings.Contains(value, ":") {
+				external = true
+			}
+		}
+		// links users put in posts to other sites aren't endorsed
+		if external {
+			out.WriteString(` rel="nofollow ugc noopener"`)
+		}
+		out.WriteString(">")
+		if name != "br" {
+			open = append(open, name)
+		}
+	}
+	writeText(src[last:])
+
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString("</" + open[i] + ">")
+	}
+	return out.String()
+}
+
+func safeAttr(tag, key, value string) bool {
+	switch key {
+	case "href":
+		return safeURL(html.UnescapeString(value))
+	case "class":
+		return value == "mention" || value == "hashtag"
+	case "start":
+		_, err := strconv.Atoi(value)
+		return err == nil
+	}
+	return false
+}
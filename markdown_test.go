@@ -0,0 +1,181 @@
+package main
+
+import (
+	"html"
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"hello *world*", "<p>hello <em>world</em></p>\n"},
+		{"**bold** and `code`", "<p><strong>bold</strong> and <code>code</code></p>\n"},
+		{"line one\nline two", "<p>line one<br>\nline two</p>\n"},
+		{"[link](https://example.com)", `<p><a href="https://example.com" rel="nofollow ugc noopener">link</a></p>` + "\n"},
+		{"[home](/tags)", `<p><a href="/tags">home</a></p>` + "\n"},
+		{"see https://example.com/a?b=1.", `<p>see <a href="https://example.com/a?b=1" rel="nofollow ugc noopener">https://example.com/a?b=1</a>.</p>` + "\n"},
+		{"@alice #go", `<p><a class="mention" href="/user/alice">@alice</a> <a class="hashtag" href="/tag/go">#go</a></p>` + "\n"},
+		{"```\n*not* emphasis\n```", "<pre><code>*not* emphasis</code></pre>\n"},
+		{"> quote\n- a\n- b", "<blockquote>\n<p>quote</p>\n</blockquote>\n<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		{"3. three\n4. four", "<ol start=\"3\">\n<li>three</li>\n<li>four</li>\n</ol>\n"},
+		{`\*escaped\*`, "<p>*escaped*</p>\n"},
+		{"`a`` b`", "<p><code>a`` b</code></p>\n"},
+		{"*unclosed", "<p>*unclosed</p>\n"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := string(renderMarkdown(test.src)); got != test.want {
+			t.Errorf("renderMarkdown(%q)\n got %q\nwant %q", test.src, got, test.want)
+		}
+	}
+}
+
+// whatever a post says, the html has only allowlisted tags, attributes and
+// link targets
+func TestRenderMarkdownXSS(t *testing.T) {
+	vectors := []string{
+		"<script>alert(1)</script>",
+		"<img src=x onerror=alert(1)>",
+		"<a href=\"javascript:alert(1)\">x</a>",
+		"<svg/onload=alert(1)>",
+		"[x](javascript:alert(1))",
+		"[x](JaVaScRiPt:alert(1))",
+		"[x](java\tscript:alert(1))",
+		"[x](java\nscript:alert(1))",
+		"[x]( javascript:alert(1))",
+		"[x](&#106;avascript:alert(1))",
+		"[x](&#x6A;avascript:alert(1))",
+		"[x](data:text/html,<script>alert(1)</script>)",
+		"[x](vbscript:msgbox(1))",
+		"[x](//evil.example)",
+		"[x](/\\evil.example)",
+		"[x](/\t/evil.example)",
+		"[x](https://e.com\"onclick=\"alert(1))",
+		"[x](https://e.com' onclick='alert(1))",
+		"[x\"><script>alert(1)</script>](https://e.com)",
+		"[<img src=x onerror=alert(1)>](https://e.com)",
+		"*[x](javascript:alert(1))*",
+		"**<b onmouseover=alert(1)>x</b>**",
+		"`</code><script>alert(1)</script>`",
+		"```\n</code></pre><script>alert(1)</script>\n```",
+		"> <iframe src=javascript:alert(1)>",
+		"- <style>*{display:none}</style>",
+		"@\"><script>alert(1)</script>",
+		"#\"><script>alert(1)</script>",
+		"https://e.com/\"><script>alert(1)</script>",
+		"javascript:alert(1)",
+		"&lt;script&gt;alert(1)&lt;/script&gt;",
+		"<a href=\"https://e.com\" onclick=\"alert(1)\">x</a>",
+		"[x](https://e.com)<!-- <script>alert(1)</script> -->",
+	}
+	for _, src := range vectors {
+		out := string(renderMarkdown(src))
+		// text is escaped, so any of these would be a real tag
+		for _, tag := range []string{"<script", "<img", "<svg", "<iframe", "<style", "<b ", "<!--"} {
+			if strings.Contains(strings.ToLower(out), tag) {
+				t.Errorf("renderMarkdown(%q) = %q, has %s", src, out, tag)
+			}
+		}
+		for _, m := range htmlTagPattern.FindAllStringSubmatch(out, -1) {
+			if _, ok := allowedTags[m[2]]; !ok {
+				t.Errorf("renderMarkdown(%q) = %q, has a <%s>", src, out, m[2])
+			}
+			for _, attr := range htmlAttrPattern.FindAllStringSubmatch(m[3], -1) {
+				if attr[1] == "href" && !safeURL(html.UnescapeString(attr[2])) {
+					t.Errorf("renderMarkdown(%q) links to %q", src, attr[2])
+				}
+				if strings.HasPrefix(attr[1], "on") || attr[1] == "style" || attr[1] == "src" {
+					t.Errorf("renderMarkdown(%q) = %q, has a %s attribute", src, out, attr[1])
+				}
+			}
+		}
+		// and nothing the sanitizer would still change
+		if again := sanitizeHTML(out); again != out {
+			t.Errorf("renderMarkdown(%q) = %q, sanitizes to %q", src, out, again)
+		}
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"<p>a<br/>b</p>", "<p>a<br>b</p>"},
+		{"<SCRIPT>alert(1)</SCRIPT>", "&lt;SCRIPT&gt;alert(1)&lt;/SCRIPT&gt;"},
+		{`<div onclick="x">a</div>`, `&lt;div onclick="x"&gt;a&lt;/div&gt;`},
+		{`<a href="javascript:alert(1)">x</a>`, "<a>x</a>"},
+		{`<a href="&#106;avascript:alert(1)">x</a>`, "<a>x</a>"},
+		{`<a href="/ok" class="evil">x</a>`, `<a href="/ok">x</a>`},
+		{`<a href="https://e.com" onclick="x" class="mention">y</a>`, `<a href="https://e.com" class="mention" rel="nofollow ugc noopener">y</a>`},
+		{`<a href="https://e.com" rel="opener">y</a>`, `<a href="https://e.com" rel="nofollow ugc noopener">y</a>`},
+		{`<ol start="x"><li>a`, "<ol><li>a</li></ol>"},
+		{`<ol start="2"><li>a</li></ol>`, `<ol start="2"><li>a</li></ol>`},
+		// closers only close the innermost tag, the rest is closed at the end
+		{"<em><strong>x</em>", "<em><strong>x</strong></em>"},
+		{"</p>stray", "stray"},
+		{"a < b > c", "a &lt; b &gt; c"},
+		{`<a href="x" <script>>`, `&lt;a href="x" &lt;script&gt;&gt;`},
+	}
+	for _, test := range tests {
+		if got := sanitizeHTML(test.src); got != test.want {
+			t.Errorf("sanitizeHTML(%q)\n got %q\nwant %q", test.src, got, test.want)
+		}
+	}
+}
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		href string
+		safe bool
+	}{
+		{"https://example.com", true},
+		{"http://example.com/a?b=c#d", true},
+		{"mailto:alice@example.com", true},
+		{"/", true},
+		{"/tag/go", true},
+		{"/user/alice?x=//y", true},
+
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{"java\tscript:alert(1)", false},
+		{"java\nscript:alert(1)", false},
+		{"data:text/html,x", false},
+		{"vbscript:x", false},
+		{"ftp://example.com", false},
+		{"//evil.example", false},
+		{"/\\evil.example", false},
+		{"/\t/evil.example", false},
+		{"/\r\n/evil.example", false},
+		{"relative/path", false},
+		{"#fragment", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := safeURL(test.href); got != test.safe {
+			t.Errorf("safeURL(%q) = %v, want %v", test.href, got, test.safe)
+		}
+	}
+}
+
+// inputs that used to make inline parsing quadratic, at the longest post
+// length
+func BenchmarkRenderMarkdownHostile(b *testing.B) {
+	inputs := map[string]string{
+		"brackets":    strings.Repeat("[", maxPostLength),
+		"links":       strings.Repeat("[a](", maxPostLength/4),
+		"emphasis":    strings.Repeat("*a", maxPostLength/2),
+		"strong":      strings.Repeat("**a", maxPostLength/3),
+		"backticks":   strings.Repeat("`a``", maxPostLength/4),
+		"autolinks":   strings.Repeat("https://", maxPostLength/8),
+		"underscores": strings.Repeat("_a ", maxPostLength/3),
+	}
+	for name, src := range inputs {
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				renderMarkdown(src)
+			}
+		})
+	}
+}
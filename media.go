@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// images attached to a post. a post can carry up to maxAttachments of them,
+// each with its own alt text, shown as a gallery in upload order
+
+// most images a single post can have (TERRACOTTA_MAX_ATTACHMENTS)
+var maxAttachments = envInt("TERRACOTTA_MAX_ATTACHMENTS", 4)
+
+// images can also be uploaded ahead of time through /api/v1/media, which
+// keeps them as pending media until a post attaches them by id. ones that
+// never get attached expire after this long (TERRACOTTA_PENDING_MEDIA_HOURS)
+var pendingMediaTTL = time.Duration(envInt("TERRACOTTA_PENDING_MEDIA_HOURS", 24)) * time.Hour
+
+// biggest request body accepted: every attachment at the biggest size, plus
+// room for the rest of the form
+var maxRequestBytes = int64(maxAttachments)*maxUploadBytes + 1<<20
+
+// caps request bodies at maxRequestBytes before anything parses them,
+// reading past it fails with *http.MaxBytesError
+func limitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+type Media struct {
+	pendingID int    // set while it's still a pending upload
+	URL       string `json:"url"`
+	ThumbURL  string `json:"thumb_url,omitempty"`
+	MediumURL string `json:"medium_url,omitempty"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	AltText   string `json:"alt_text"`
+}
+
+// srcset covering whichever resized variants exist, "" if there are none
+func (m Media) Srcset() string {
+	var sizes []string
+	if m.ThumbURL != "" {
+		sizes = append(sizes, m.ThumbURL+" "+strconv.Itoa(thumbImageWidth)+"w")
+	}
+	if m.MediumURL != "" {
+		sizes = append(sizes, m.MediumURL+" "+strconv.Itoa(mediumImageWidth)+"w")
+	}
+	if len(sizes) == 0 || m.Width == 0 {
+		return ""
+	}
+	sizes = append(sizes, m.URL+" "+strconv.Itoa(m.Width)+"w")
+	return strings.Join(sizes, ", ")
+}
+
+// attachments the user got wrong, the message is shown to them
+type attachmentError struct {
+	reason string
+}
+
+func (e attachmentError) Error() string {
+	return e.reason
+}
+
+// the media for a post being created from a form: pending uploads picked by
+// "media_id" (paired with "media_alt"), then the "image" files (paired with
+// "alt"). no ids and no files just means no media
+func saveUploadedMedia(r *http.Request, userID int) ([]Media, error) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		return nil, err
+	}
+
+	var ids []int
+	for _, value := range r.Form["media_id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, attachmentError{"invalid media id"}
+		}
+		ids = append(ids, id)
+	}
+	pending, err := getPendingMedia(userID, ids, r.Form["media_alt"])
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*multipart.FileHeader
+	var alts []string
+	if r.MultipartForm != nil {
+		files = r.MultipartForm.File["image"]
+		alts = r.MultipartForm.Value["alt"]
+	}
+	if len(pending)+len(files) > maxAttachments {
+		return nil, attachmentError{fmt.Sprintf("a post can have at most %d images", maxAttachments)}
+	}
+
+	// check everything before storing anything
+	media := make([]Media, len(files))
+	for i := range files {
+		if i < len(alts) {
+			media[i].AltText = strings.TrimSpace(alts[i])
+		}
+		if media[i].AltText == "" {
+			return nil, attachmentError{"every image needs alt text"}
+		}
+	}
+
+	// if a later file fails, the ones already stored are unreferenced and
+	// get picked up by the upload GC
+	for i, header := range files {
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		processed, err := processImage(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		stored, err := storeImage(processed)
+		if err != nil {
+			return nil, err
+		}
+		media[i].URL = stored.URL
+		media[i].ThumbURL = stored.ThumbURL
+		media[i].MediumURL = stored.MediumURL
+		media[i].Width = stored.Width
+		media[i].Height = stored.Height
+	}
+	return append(pending, media...), nil
+}
+
+// stores an image uploaded ahead of its post, returns the pending media id
+func createPendingMedia(userID int, image StoredImage) (int, error) {
+	result, err := db.Exec(`
+		INSERT INTO pending_media (user_id, url, thumb_url, medium_url, width, height)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, userID, image.URL, image.ThumbURL, image.MediumURL, image.Width, image.Height)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// looks up the user's pending uploads by id, in the order given, with the
+// alt text paired up by position
+func getPendingMedia(userID int, ids []int, alts []string) ([]Media, error) {
+	if len(ids) > maxAttachments {
+		return nil, attachmentError{fmt.Sprintf("a post can have at most %d images", maxAttachments)}
+	}
+
+	media := make([]Media, len(ids))
+	seen := make(map[int]bool)
+	for i, id := range ids {
+		if seen[id] {
+			return nil, attachmentError{"the same image can't be attached twice"}
+		}
+		seen[id] = true
+
+		if i < len(alts) {
+			media[i].AltText = strings.TrimSpace(alts[i])
+		}
+		if media[i].AltText == "" {
+			return nil, attachmentError{"every image needs alt text"}
+		}
+
+		// someone else's upload looks the same as one that doesn't exist
+		err := db.QueryRow(`
+			SELECT id, url, thumb_url, medium_url, width, height
+			FROM pending_media
+			WHERE id = ? AND user_id = ?
+		`, id, userID).Scan(&media[i].pendingID, &media[i].URL, &media[i].ThumbURL, &media[i].MediumURL, &media[i].Width, &media[i].Height)
+		if err == sql.ErrNoRows {
+			return nil, attachmentError{fmt.Sprintf("media %d not found, it may have expired", id)}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return media, nil
+}
+
+// drops pending uploads nobody attached in time. their files are then
+// unreferenced and get removed by the upload GC
+func expirePendingMedia() (int64, error) {
+	result, err := db.Exec("DELETE FROM pending_media WHERE created_at < datetime('now', ?)",
+		fmt.Sprintf("-%d seconds", int(pendingMediaTTL.Seconds())))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// attaches the media to the post, pending uploads stop being pending
+func insertPostMedia(tx *sql.Tx, postID int, media []Media) error {
+	for i, m := range media {
+		_, err := tx.Exec(`
+			INSERT INTO post_media (post_id, position, url, thumb_url, medium_url, width, height, alt_text)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, postID, i, m.URL, m.ThumbURL, m.MediumURL, m.Width, m.Height, m.AltText)
+		if err != nil {
+			return err
+		}
+
+		// another post may have attached it since it was looked up, then
+		// this one doesn't get it too
+		if m.pendingID != 0 {
+			result, err := tx.Exec("DELETE FROM pending_media WHERE id = ?", m.pendingID)
+			if err != nil {
+				return err
+			}
+			if n, err := result.RowsAffected(); err != nil {
+				return err
+			} else if n != 1 {
+				return attachmentError{fmt.Sprintf("media %d not found, it may have been attached to another post", m.pendingID)}
+			}
+		}
+	}
+	return nil
+}
+
+// loads the media for all the given posts in one query, keyed by post id
+func loadPostMedia(postIDs []int) map[int][]Media {
+	mediaByPost := make(map[int][]Media)
+	if len(postIDs) == 0 {
+		return mediaByPost
+	}
+
+	ids := make([]any, len(postIDs))
+	for i, id := range postIDs {
+		ids[i] = id
+	}
+	placeholders := strings.Repeat("?,", len(ids))
+	placeholders = placeholders[:len(placeholders)-1]
+
+	rows, err := db.Query(`
+		SELECT post_id, url, thumb_url, medium_url, width, height, alt_text
+		FROM post_media
+		WHERE post_id IN (`+placeholders+`)
+		ORDER BY post_id, position`, ids...)
+	if err != nil {
+		log.Printf("Error fetching media for posts: %v", err)
+		return mediaByPost
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int
+		var m Media
+		if err := rows.Scan(&postID, &m.URL, &m.ThumbURL, &m.MediumURL, &m.Width, &m.Height, &m.AltText); err != nil {
+			log.Printf("Error scanning media: %v", err)
+			continue
+		}
+		mediaByPost[postID] = append(mediaByPost[postID], m)
+	}
+	return mediaByPost
+}
+
+func attachPostMedia(posts []Post) {
+	ids := make([]int, len(posts))
+	for i, post := range posts {
+		ids[i] = post.ID
+	}
+
+	mediaByPost := loadPostMedia(ids)
+	for i := range posts {
+		posts[i].Media = mediaByPost[posts[i].ID]
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// two posts that picked the same pending upload can't both attach it
+func TestPendingMediaAttachedOnce(t *testing.T) {
+	openTestDB(t)
+	if _, err := db.Exec("INSERT INTO users (id, username, password_hash) VALUES (1, 'alice', '')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO pending_media (id, user_id, url) VALUES (7, 1, '/uploads/a.png')"); err != nil {
+		t.Fatal(err)
+	}
+	// both looked it up before either was saved
+	media := []Media{{pendingID: 7, URL: "/uploads/a.png", AltText: "a cat"}}
+
+	if _, err := createPost("alice", "first", media, "regular", nil, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err := createPost("alice", "second", media, "regular", nil, nil, "")
+	var badAttachment attachmentError
+	if !errors.As(err, &badAttachment) {
+		t.Fatalf("second post = %v, want an attachmentError", err)
+	}
+
+	var posts, attached int
+	db.QueryRow("SELECT COUNT(*) FROM posts").Scan(&posts)
+	db.QueryRow("SELECT COUNT(*) FROM post_media WHERE url = '/uploads/a.png'").Scan(&attached)
+	if posts != 1 || attached != 1 {
+		t.Errorf("%d posts and %d attachments, want the second post rolled back", posts, attached)
+	}
+}
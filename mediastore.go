@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// where uploaded media lives. names are flat file names like
+// "<random hex>.png", never paths, and they're never reused
+type MediaStore interface {
+	Put(name string, data []byte) error
+	Delete(name string) error
+	// every stored file, for the upload GC
+	List() ([]StoredFile, error)
+	// answers a request for /uploads/<name>
+	Serve(w http.ResponseWriter, r *http.Request, name string)
+}
+
+type StoredFile struct {
+	Name    string
+	ModTime time.Time
+}
+
+var mediaStore MediaStore
+
+// picks the backend from TERRACOTTA_MEDIA_STORE, "local" (default) or "s3"
+func newMediaStore() (MediaStore, error) {
+	switch kind := envString("TERRACOTTA_MEDIA_STORE", "local"); kind {
+	case "local":
+		return localMediaStore{dir: uploadsDir}, nil
+	case "s3":
+		return newS3MediaStore()
+	default:
+		return nil, fmt.Errorf("unknown TERRACOTTA_MEDIA_STORE %q, use local or s3", kind)
+	}
+}
+
+// content type a stored file should be served with
+func mediaContentType(name string) string {
+	contentType := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+// where the local store keeps its files
+const uploadsDir = "./uploads"
+
+// keeps media in a directory on the app server
+type localMediaStore struct {
+	dir string
+}
+
+func (s localMediaStore) Put(name string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, name), data, 0644)
+}
+
+func (s localMediaStore) Delete(name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
+
+func (s localMediaStore) List() ([]StoredFile, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var files []StoredFile
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, StoredFile{Name: entry.Name(), ModTime: info.ModTime()})
+	}
+	return files, nil
+}
+
+// names are random and never reused, so they can be cached forever.
+// ServeContent handles range requests
+func (s localMediaStore) Serve(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// only ever serve images inline, anything else is a download
+	contentType := mediaContentType(name)
+	if !strings.HasPrefix(contentType, "image/") || contentType == "image/svg+xml" {
+		contentType = "application/octet-stream"
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, stat.ModTime(), f)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// @mentions and #hashtags in post content. the markdown renderer links
+// them, and when a post is saved the same pass finds which ones it has:
+// mentions of real users go in the mentions table, hashtags become tags
+// like the ones from the tags field
+
+// the mentions and hashtags in a post, in the order they appear
+type contentRefs struct {
+	Mentions []string
+	Hashtags []string
+}
+
+func (refs *contentRefs) addMention(name string) {
+	if refs != nil && !slices.Contains(refs.Mentions, name) {
+		refs.Mentions = append(refs.Mentions, name)
+	}
+}
+
+func (refs *contentRefs) addHashtag(name string) {
+	if refs != nil && !slices.Contains(refs.Hashtags, name) {
+		refs.Hashtags = append(refs.Hashtags, name)
+	}
+}
+
+// finds the mentions and hashtags the rendered post would link. anything
+// in code or inside a link doesn't count
+func extractContentRefs(content string) contentRefs {
+	var refs contentRefs
+	renderBlocks(splitLines(content), 0, &refs)
+	return refs
+}
+
+// the username after an @, "" if there isn't one. a trailing . or - is
+// punctuation, not part of the name
+func scanMention(text string) string {
+	end := scanRunes(text, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+	})
+	return strings.TrimRight(text[:end], ".-")
+}
+
+// the tag after a #, "" if there isn't one. names normalizeTag rejects
+// aren't tags, so "#1" stays a number and an over-long one isn't linked to
+// a tag page that can't exist
+func scanHashtag(text string) string {
+	end := scanRunes(text, isTagRune)
+	name := strings.TrimRight(text[:end], "-")
+	if _, err := normalizeTag(name); err != nil {
+		return ""
+	}
+	return name
+}
+
+// a bare http(s) url at the start of text, "" if there isn't one. trailing
+// punctuation is left out, and so is a ) that closes a paren opened before
+// the url
+func scanURL(text string) string {
+	if !strings.HasPrefix(text, "http://") && !strings.HasPrefix(text, "https://") {
+		return ""
+	}
+	// longer urls aren't linked, which keeps this from scanning the whole
+	// post for every http in it
+	if len(text) > maxURLLength+1 {
+		text = text[:maxURLLength+1]
+	}
+	end := strings.IndexFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '<' || r == '>' || r == '"'
+	})
+	if end < 0 {
+		end = len(text)
+	}
+	if end > maxURLLength {
+		return ""
+	}
+	href := text[:end]
+	for {
+		trimmed := strings.TrimRight(href, ".,:;!?'*_")
+		if strings.HasSuffix(trimmed, ")") && strings.Count(trimmed, ")") > strings.Count(trimmed, "(") {
+			trimmed = trimmed[:len(trimmed)-1]
+		}
+		if trimmed == href {
+			break
+		}
+		href = trimmed
+	}
+	if !strings.Contains(strings.SplitN(href, "://", 2)[1], ".") || !safeURL(href) {
+		return ""
+	}
+	return href
+}
+
+// length of the prefix of text whose runes all match fn
+func scanRunes(text string, fn func(rune) bool) int {
+	end := 0
+	for end < len(text) {
+		r, size := utf8.DecodeRuneInString(text[end:])
+		if !fn(r) {
+			break
+		}
+		end += size
+	}
+	return end
+}
+
+// records who the post mentions, replacing what was there before. names
+// that aren't users are skipped
+func savePostMentions(tx *sql.Tx, postID int, mentions []string) error {
+	if _, err := tx.Exec("DELETE FROM mentions WHERE post_id = ?", postID); err != nil {
+		return err
+	}
+	for _, name := range mentions {
+		_, err := tx.Exec("INSERT OR IGNORE INTO mentions (post_id, user_id) SELECT ?, id FROM users WHERE username = ?", postID, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stores the mentions and hashtags in the post's content. hashtags only add
+// tags, a tag from the tags field stays even if the content doesn't have it.
+// taggable is false for replies that can't have tags
+func savePostRefs(tx *sql.Tx, postID int, content string, taggable bool) error {
+	refs := extractContentRefs(content)
+	if err := savePostMentions(tx, postID, refs.Mentions); err != nil {
+		return err
+	}
+
+	if taggable {
+		return insertPostTags(tx, postID, refs.Hashtags)
+	}
+	return nil
+}
+
+type UserPageData struct {
+	Username   string         `json:"username"`
+	CSRFToken  string         `json:"-"`
+	Profile    string         `json:"profile"`
+	Posts      []Post         `json:"posts"`
+	Pagination *Pagination    `json:"pagination,omitempty"`
+	TimeZone   *time.Location `json:"-"`
+}
+
+// someone's posts, newest first
+func getUserPosts(username string, page PageRequest) ([]Post, Pagination, error) {
+	return getFeedPosts("posts.username = ?", page, username)
+}
+
+// profile page, /user/{name}
+func userHandler(w http.ResponseWriter, r *http.Request) {
+	profile := r.PathValue("name")
+
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", profile).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	posts, pagination, err := getUserPosts(profile, pageRequestFromQuery(r))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	templates.ExecuteTemplate(w, "user.html", UserPageData{
+		Username:   getUsername(r),
+		CSRFToken:  csrfToken(w, r),
+		Profile:    profile,
+		Posts:      posts,
+		Pagination: &pagination,
+		TimeZone:   viewerLocation(r, time.UTC),
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestScanMention(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"alice", "alice"},
+		{"alice said", "alice"},
+		{"alice.", "alice"},
+		{"alice, bob", "alice"},
+		{"alice-", "alice"},
+		{"a.lice_b-o", "a.lice_b-o"},
+		{"alice...", "alice"},
+		{"zoë!", "zoë"},
+		{"alice's post", "alice"},
+		{"", ""},
+		{" alice", ""},
+		{"-", ""},
+	}
+	for _, test := range tests {
+		if got := scanMention(test.text); got != test.want {
+			t.Errorf("scanMention(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestScanURL(t *testing.T) {
+	long := "https://example.com/" + strings.Repeat("a", maxURLLength)
+	tests := []struct {
+		text, want string
+	}{
+		{"https://example.com", "https://example.com"},
+		{"http://example.com/a?b=c&d=e#f more", "http://example.com/a?b=c&d=e#f"},
+		{"https://example.com.", "https://example.com"},
+		{"https://example.com/path?!", "https://example.com/path"},
+		{"https://example.com/a.b.", "https://example.com/a.b"},
+		{"https://example.com/*emphasis*", "https://example.com/*emphasis"},
+		{"https://example.com/<script>", "https://example.com/"},
+		{`https://example.com/"onclick="x`, "https://example.com/"},
+		// parens that belong to the url stay, ones from around it don't
+		{"https://en.wikipedia.org/wiki/Go_(programming_language)", "https://en.wikipedia.org/wiki/Go_(programming_language)"},
+		{"https://example.com/a)", "https://example.com/a"},
+		{"https://example.com/a).", "https://example.com/a"},
+		{"https://example.com/a(b)).", "https://example.com/a(b)"},
+		{"https://münchen.de/straße", "https://münchen.de/straße"},
+
+		{"https://localhost", ""},
+		{"https://", ""},
+		{"http:/example.com", ""},
+		{"ftp://example.com", ""},
+		{"javascript://example.com/%0aalert(1)", ""},
+		{"example.com", ""},
+		{" https://example.com", ""},
+		{long, ""},
+		{long[:maxURLLength] + " more", long[:maxURLLength]},
+	}
+	for _, test := range tests {
+		if got := scanURL(test.text); got != test.want {
+			t.Errorf("scanURL(%.60q) = %.60q, want %.60q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestExtractContentRefs(t *testing.T) {
+	tests := []struct {
+		content  string
+		mentions []string
+		hashtags []string
+	}{
+		{"hi @alice and @bob, #go #Go #rust", []string{"alice", "bob"}, []string{"go", "Go", "rust"}},
+		{"@alice @alice #go #go", []string{"alice"}, []string{"go"}},
+		// not in code or links, and not in the middle of a word
+		{"`@alice #go` [@bob #rust](https://example.com)", nil, nil},
+		{"```\n@alice #go\n```", nil, nil},
+		{"email@example.com issue#12", nil, nil},
+		{"> quoted @carol\n- listed #lists", []string{"carol"}, []string{"lists"}},
+		{"**@dave** *#emph*", []string{"dave"}, []string{"emph"}},
+		{"#1 and #" + strings.Repeat("x", 40), nil, nil},
+	}
+	for _, test := range tests {
+		refs := extractContentRefs(test.content)
+		if !slices.Equal(refs.Mentions, test.mentions) || !slices.Equal(refs.Hashtags, test.hashtags) {
+			t.Errorf("extractContentRefs(%q) = %q %q, want %q %q", test.content, refs.Mentions, refs.Hashtags, test.mentions, test.hashtags)
+		}
+	}
+}
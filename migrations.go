@@ -0,0 +1,606 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// a single schema change. migrations are applied in Version order and each
+// one runs inside its own transaction, so a failure leaves the db untouched
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error
+}
+
+// add new migrations to the end of this list, never edit or reorder old ones
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial_schema",
+		Up: func(tx *sql.Tx) error {
+			err := execStatements(tx,
+				`CREATE TABLE IF NOT EXISTS users (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					username TEXT UNIQUE NOT NULL,
+					password_hash TEXT NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS posts (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					username TEXT NOT NULL,
+					content TEXT NOT NULL,
+					parent_id INTEGER,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (parent_id) REFERENCES posts(id)
+				)`,
+				`CREATE TABLE IF NOT EXISTS likes (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					post_id INTEGER NOT NULL,
+					FOREIGN KEY (user_id) REFERENCES users(id),
+					FOREIGN KEY (post_id) REFERENCES posts(id),
+					UNIQUE (user_id, post_id)
+				)`,
+				`CREATE TABLE IF NOT EXISTS tags (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT UNIQUE NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS post_tags (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					post_id INTEGER NOT NULL,
+					tag_id INTEGER NOT NULL,
+					FOREIGN KEY (post_id) REFERENCES posts(id),
+					FOREIGN KEY (tag_id) REFERENCES tags(id),
+					UNIQUE (post_id, tag_id)
+				)`,
+			)
+			if err != nil {
+				return err
+			}
+			// dbs made from the old dbSetup.txt don't have replies
+			return addColumnIfMissing(tx, "posts", "parent_id", "INTEGER REFERENCES posts(id)")
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx,
+				"DROP TABLE IF EXISTS post_tags",
+				"DROP TABLE IF EXISTS tags",
+				"DROP TABLE IF EXISTS likes",
+				"DROP TABLE IF EXISTS posts",
+				"DROP TABLE IF EXISTS users",
+			)
+		},
+	},
+	{
+		Version: 2,
+		Name:    "posts_type_and_image",
+		Up: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "posts", "post_type", "TEXT DEFAULT 'regular'"); err != nil {
+				return err
+			}
+			return addColumnIfMissing(tx, "posts", "image_url", "TEXT NOT NULL DEFAULT ''")
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx,
+				"ALTER TABLE posts DROP COLUMN image_url",
+				"ALTER TABLE posts DROP COLUMN post_type",
+			)
+		},
+	},
+	{
+		Version: 3,
+		Name:    "sessions",
+		Up: func(tx *sql.Tx) error {
+			// recreated from scratch, this logs everyone out once
+			return execStatements(tx,
+				"DROP TABLE IF EXISTS sessions",
+				`CREATE TABLE sessions (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					token_hash TEXT UNIQUE NOT NULL,
+					user_id INTEGER NOT NULL,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					last_seen_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					expires_at DATETIME NOT NULL,
+					user_agent TEXT NOT NULL DEFAULT '',
+					ip_address TEXT NOT NULL DEFAULT '',
+					csrf_token TEXT NOT NULL DEFAULT '',
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				)`,
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx, "DROP TABLE IF EXISTS sessions")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "api_tokens",
+		Up: func(tx *sql.Tx) error {
+			return execStatements(tx,
+				`CREATE TABLE api_tokens (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					name TEXT NOT NULL,
+					token_hash TEXT UNIQUE NOT NULL,
+					scope TEXT NOT NULL DEFAULT 'read',
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					last_used_at DATETIME,
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				)`,
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx, "DROP TABLE IF EXISTS api_tokens")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "posts_feed_index",
+		Up: func(tx *sql.Tx) error {
+			// keyset pagination walks posts by (created_at, id)
+			return execStatements(tx,
+				"CREATE INDEX IF NOT EXISTS idx_posts_created_at_id ON posts(created_at, id)",
+				"CREATE INDEX IF NOT EXISTS idx_posts_parent_id ON posts(parent_id)",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx,
+				"DROP INDEX IF EXISTS idx_posts_parent_id",
+				"DROP INDEX IF EXISTS idx_posts_created_at_id",
+			)
+		},
+	},
+	{
+		Version: 6,
+		Name:    "feed_count_indexes",
+		Up: func(tx *sql.Tx) error {
+			// feeds walk top-level posts in order, and count likes/replies per post
+			return execStatements(tx,
+				"CREATE INDEX IF NOT EXISTS idx_posts_feed ON posts(parent_id, created_at, id)",
+				"CREATE INDEX IF NOT EXISTS idx_likes_post_id ON likes(post_id)",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx,
+				"DROP INDEX IF EXISTS idx_likes_post_id",
+				"DROP INDEX IF EXISTS idx_posts_feed",
+			)
+		},
+	},
+	{
+		Version: 7,
+		Name:    "post_media",
+		Up: func(tx *sql.Tx) error {
+			// posts can have several images, each with resized copies for
+			// srcset (empty when the original is already small enough, or
+			// it's a gif). the single image column moves over as each post's
+			// first attachment
+			return execStatements(tx,
+				`CREATE TABLE post_media (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					post_id INTEGER NOT NULL,
+					position INTEGER NOT NULL,
+					url TEXT NOT NULL,
+					thumb_url TEXT NOT NULL DEFAULT '',
+					medium_url TEXT NOT NULL DEFAULT '',
+					width INTEGER NOT NULL DEFAULT 0,
+					height INTEGER NOT NULL DEFAULT 0,
+					alt_text TEXT NOT NULL DEFAULT '',
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (post_id) REFERENCES posts(id),
+					UNIQUE (post_id, position)
+				)`,
+				`INSERT INTO post_media (post_id, position, url)
+					SELECT id, 0, image_url FROM posts WHERE image_url != ''`,
+				"ALTER TABLE posts DROP COLUMN image_url",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			// only the first image of each post survives going back
+			return execStatements(tx,
+				"ALTER TABLE posts ADD COLUMN image_url TEXT NOT NULL DEFAULT ''",
+				`UPDATE posts SET image_url = (
+					SELECT url FROM post_media
+					WHERE post_media.post_id = posts.id AND position = 0
+				)
+				WHERE id IN (SELECT post_id FROM post_media WHERE position = 0)`,
+				"DROP TABLE post_media",
+			)
+		},
+	},
+	{
+		Version: 8,
+		Name:    "pending_media",
+		Up: func(tx *sql.Tx) error {
+			// images uploaded ahead of the post they'll be attached to
+			return execStatements(tx,
+				`CREATE TABLE pending_media (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					url TEXT NOT NULL,
+					thumb_url TEXT NOT NULL DEFAULT '',
+					medium_url TEXT NOT NULL DEFAULT '',
+					width INTEGER NOT NULL DEFAULT 0,
+					height INTEGER NOT NULL DEFAULT 0,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				)`,
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx, "DROP TABLE pending_media")
+		},
+	},
+	{
+		Version: 9,
+		Name:    "post_revisions",
+		Up: func(tx *sql.Tx) error {
+			// every version of a post that got replaced by an edit, written_at
+			// is when that version was written (created or last edited)
+			return execStatements(tx,
+				"ALTER TABLE posts ADD COLUMN edited_at DATETIME",
+				`CREATE TABLE post_revisions (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					post_id INTEGER NOT NULL,
+					content TEXT NOT NULL,
+					written_at DATETIME NOT NULL,
+					FOREIGN KEY (post_id) REFERENCES posts(id)
+				)`,
+				"CREATE INDEX idx_post_revisions_post_id ON post_revisions(post_id)",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx,
+				"DROP TABLE post_revisions",
+				"ALTER TABLE posts DROP COLUMN edited_at",
+			)
+		},
+	},
+	{
+		Version: 10,
+		Name:    "posts_deleted_at",
+		Up: func(tx *sql.Tx) error {
+			// soft delete, the purge job removes rows once they're old enough
+			return execStatements(tx,
+				"ALTER TABLE posts ADD COLUMN deleted_at DATETIME",
+				"CREATE INDEX idx_posts_deleted_at ON posts(deleted_at) WHERE deleted_at IS NOT NULL",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx,
+				"DROP INDEX idx_posts_deleted_at",
+				"ALTER TABLE posts DROP COLUMN deleted_at",
+			)
+		},
+	},
+	{
+		Version: 11,
+		Name:    "mentions",
+		Up: func(tx *sql.Tx) error {
+			// users @mentioned in a post
+			return execStatements(tx,
+				`CREATE TABLE mentions (
+					post_id INTEGER NOT NULL,
+					user_id INTEGER NOT NULL,
+					PRIMARY KEY (post_id, user_id),
+					FOREIGN KEY (post_id) REFERENCES posts(id),
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				)`,
+				"CREATE INDEX idx_mentions_user_id ON mentions(user_id)",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx, "DROP TABLE mentions")
+		},
+	},
+	{
+		Version: 12,
+		Name:    "tag_aliases",
+		Up: func(tx *sql.Tx) error {
+			// other names for a tag, stored normalized like tag names
+			err := execStatements(tx,
+				`CREATE TABLE tag_aliases (
+					alias TEXT PRIMARY KEY,
+					tag_id INTEGER NOT NULL,
+					FOREIGN KEY (tag_id) REFERENCES tags(id)
+				)`,
+				"CREATE INDEX idx_tag_aliases_tag_id ON tag_aliases(tag_id)",
+			)
+			if err != nil {
+				return err
+			}
+			// tags used to be stored as typed
+			_, err = normalizeExistingTags(tx)
+			return err
+		},
+		Down: func(tx *sql.Tx) error {
+			// tags stay normalized, there's no telling how they were typed
+			return execStatements(tx, "DROP TABLE tag_aliases")
+		},
+	},
+	{
+		Version: 13,
+		Name:    "journals",
+		Up: func(tx *sql.Tx) error {
+			// day-numbered journals, dates are YYYY-MM-DD. journal posts
+			// used to all count from a hardcoded 2025-06-01, they move
+			// to a journal that starts then
+			return execStatements(tx,
+				`CREATE TABLE journals (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					slug TEXT UNIQUE NOT NULL,
+					name TEXT NOT NULL,
+					start_date TEXT NOT NULL,
+					end_date TEXT,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+				)`,
+				"ALTER TABLE posts ADD COLUMN journal_id INTEGER REFERENCES journals(id)",
+				"CREATE INDEX idx_posts_journal_id ON posts(journal_id, created_at, id)",
+				"INSERT INTO journals (slug, name, start_date) VALUES ('neighborhood', 'neighborhood journal', '2025-06-01')",
+				"UPDATE posts SET journal_id = (SELECT id FROM journals WHERE slug = 'neighborhood') WHERE post_type = 'journal'",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx,
+				"DROP INDEX idx_posts_journal_id",
+				"ALTER TABLE posts DROP COLUMN journal_id",
+				"DROP TABLE journals",
+			)
+		},
+	},
+	{
+		Version: 14,
+		Name:    "time_zones",
+		Up: func(tx *sql.Tx) error {
+			// IANA zone names. users without one see UTC, journals start
+			// out in UTC like before
+			return execStatements(tx,
+				"ALTER TABLE users ADD COLUMN time_zone TEXT",
+				"ALTER TABLE journals ADD COLUMN time_zone TEXT NOT NULL DEFAULT 'UTC'",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx,
+				"ALTER TABLE journals DROP COLUMN time_zone",
+				"ALTER TABLE users DROP COLUMN time_zone",
+			)
+		},
+	},
+	{
+		Version: 15,
+		Name:    "posts_content_html",
+		Up: func(tx *sql.Tx) error {
+			// posts are rendered when they're written instead of on every
+			// view, existing ones are rendered now
+			if err := execStatements(tx, "ALTER TABLE posts ADD COLUMN content_html TEXT"); err != nil {
+				return err
+			}
+			return rerenderPosts(tx)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execStatements(tx, "ALTER TABLE posts DROP COLUMN content_html")
+		},
+	},
+}
+
+// helper for migrations that are just a list of statements
+func execStatements(tx *sql.Tx, statements ...string) error {
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func columnExists(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// lets migrations adopt dbs that were set up before schema_migrations existed
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	exists, err := columnExists(tx, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func ensureMigrationsTable() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)
+	return err
+}
+
+// version -> applied_at
+func appliedMigrations() (map[int]string, error) {
+	if err := ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func applyMigration(m Migration, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if up {
+		err = m.Up(tx)
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+		}
+	} else {
+		err = m.Down(tx)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	return tx.Commit()
+}
+
+// refuses a db whose applied migrations aren't the ones in this list,
+// migrating it would skip or repeat steps. the list was squashed once before
+// its first release, dbs migrated by builds from before that have to be
+// recreated
+func checkMigrationHistory() error {
+	known := make(map[int]string)
+	for _, m := range migrations {
+		known[m.Version] = m.Name
+	}
+
+	rows, err := db.Query("SELECT version, name FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var name string
+		if err := rows.Scan(&version, &name); err != nil {
+			return err
+		}
+		if known[version] != name {
+			return fmt.Errorf("migration %d was applied as %q, which this build doesn't have. the db was migrated by an unreleased build, recreate it", version, name)
+		}
+	}
+	return rows.Err()
+}
+
+// applies every pending migration in order
+func migrateUp() error {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+	if err := checkMigrationHistory(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := applyMigration(m, true); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %d (%s)", m.Version, m.Name)
+	}
+	return nil
+}
+
+// rolls back the newest `steps` applied migrations
+func migrateDown(steps int) error {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+	if err := checkMigrationHistory(); err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if err := applyMigration(m, false); err != nil {
+			return err
+		}
+		log.Printf("Rolled back migration %d (%s)", m.Version, m.Name)
+		steps--
+	}
+	return nil
+}
+
+func printMigrationStatus() error {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		status := "pending"
+		if appliedAt, ok := applied[m.Version]; ok {
+			status = "applied " + appliedAt
+		}
+		fmt.Printf("%4d  %-30s %s\n", m.Version, m.Name, status)
+	}
+	return nil
+}
+
+// `terracotta migrate up|down [n]|status`
+func runMigrateCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: terracotta migrate up|down [n]|status")
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "up":
+		err = migrateUp()
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("Invalid step count %q", args[1])
+			}
+		}
+		err = migrateDown(steps)
+	case "status":
+		err = printMigrationStatus()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q\n", args[0])
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
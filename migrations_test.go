@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// points db at a fresh, migrated database for the rest of the test
+func openTestDB(tb testing.TB) {
+	tb.Helper()
+	testDB, err := sql.Open("sqlite3", filepath.Join(tb.TempDir(), "test.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	previous := db
+	db = testDB
+	tb.Cleanup(func() {
+		testDB.Close()
+		db = previous
+	})
+
+	// without a line for every migration
+	log.SetOutput(io.Discard)
+	err = migrateUp()
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// tables with their columns and indexes, to compare schemas with
+func schemaSnapshot(t *testing.T) string {
+	t.Helper()
+	rows, err := db.Query(`SELECT type, name, tbl_name FROM sqlite_master
+		WHERE name NOT LIKE 'sqlite_%' ORDER BY tbl_name, type DESC, name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var objects [][3]string
+	for rows.Next() {
+		var o [3]string
+		if err := rows.Scan(&o[0], &o[1], &o[2]); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, o)
+	}
+	rows.Close()
+
+	var b strings.Builder
+	for _, o := range objects {
+		fmt.Fprintf(&b, "%s %s\n", o[0], o[1])
+		if o[0] != "table" {
+			continue
+		}
+		columns, err := db.Query("SELECT name, type, \"notnull\", COALESCE(dflt_value, ''), pk FROM pragma_table_info(?) ORDER BY name", o[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for columns.Next() {
+			var name, typ, dflt string
+			var notNull, pk int
+			if err := columns.Scan(&name, &typ, &notNull, &dflt, &pk); err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(&b, "  %s %s notnull=%d default=%s pk=%d\n", name, typ, notNull, dflt, pk)
+		}
+		columns.Close()
+	}
+	return b.String()
+}
+
+// every migration can be rolled back, and applying it again gives the
+// same schema it did the first time
+func TestMigrateDownAndUp(t *testing.T) {
+	openTestDB(t)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	// schemas[i] is the schema with the first i migrations applied
+	schemas := make([]string, len(migrations)+1)
+	schemas[len(migrations)] = schemaSnapshot(t)
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if err := migrateDown(1); err != nil {
+			t.Fatal(err)
+		}
+		schemas[i] = schemaSnapshot(t)
+	}
+	if applied, err := appliedMigrations(); err != nil || len(applied) != 0 {
+		t.Fatalf("after rolling everything back applied = %v, %v", applied, err)
+	}
+	if got := schemas[0]; strings.Count(got, "table ") != 1 || !strings.HasPrefix(got, "table schema_migrations\n") {
+		t.Errorf("rolling everything back left\n%s", got)
+	}
+
+	for i, m := range migrations {
+		if err := applyMigration(m, true); err != nil {
+			t.Fatal(err)
+		}
+		if got := schemaSnapshot(t); got != schemas[i+1] {
+			t.Errorf("migration %d (%s) after a round trip:\n%s\nwant\n%s", m.Version, m.Name, got, schemas[i+1])
+		}
+	}
+
+	// and up is a no-op once everything is applied
+	if err := migrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	if got := schemaSnapshot(t); got != schemas[len(migrations)] {
+		t.Errorf("migrateUp on an up to date db changed the schema")
+	}
+}
+
+// a db migrated by a build with a different list isn't migrated further
+func TestMigrateRefusesUnknownHistory(t *testing.T) {
+	openTestDB(t)
+	if _, err := db.Exec("UPDATE schema_migrations SET name = 'posts_image_variants' WHERE version = 7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUp(); err == nil || !strings.Contains(err.Error(), "posts_image_variants") {
+		t.Errorf("migrateUp = %v, want an error about posts_image_variants", err)
+	}
+	if err := migrateDown(1); err == nil {
+		t.Error("migrateDown on an unknown history succeeded")
+	}
+
+	if _, err := db.Exec("UPDATE schema_migrations SET name = 'post_media' WHERE version = 7"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, name) VALUES (999, 'from_the_future')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUp(); err == nil {
+		t.Error("migrateUp with a migration this build doesn't have succeeded")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// keyset pagination for the feeds. posts are ordered by (created_at, id) and
+// a cursor is just the id of the post at the edge of the current page, so
+// pages stay stable while new posts come in
+
+type PageRequest struct {
+	Before int // only posts older than this post id
+	After  int // only posts newer than this post id
+	Limit  int
+}
+
+type Pagination struct {
+	OlderCursor int `json:"older_cursor,omitempty"` // 0 when there's nothing older
+	NewerCursor int `json:"newer_cursor,omitempty"` // 0 when there's nothing newer
+}
+
+// reads ?before=, ?after= and ?limit= from the url
+func pageRequestFromQuery(r *http.Request) PageRequest {
+	query := r.URL.Query()
+	page := PageRequest{Limit: pageSize}
+
+	if before, err := strconv.Atoi(query.Get("before")); err == nil && before > 0 {
+		page.Before = before
+	} else if after, err := strconv.Atoi(query.Get("after")); err == nil && after > 0 {
+		page.After = after
+	}
+
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 {
+		page.Limit = min(limit, maxPageSize)
+	}
+	return page
+}
+
+// one page of top-level posts matching the where clause, newest first.
+// args fill in the where clause's placeholders
+func getFeedPosts(where string, page PageRequest, args ...any) ([]Post, Pagination, error) {
+	// counts are correlated subqueries so they only run for the rows on this
+	// page, joining likes and replies would fan out every row first. the
+	// reply count walks the whole reply tree, not just direct replies
+	query := `
+		SELECT
+			posts.id,
+			posts.content,
+			COALESCE(posts.content_html, ''),
+			posts.username,
+			(SELECT COUNT(*) FROM likes WHERE likes.post_id = posts.id) AS likes,
+			(
+				WITH RECURSIVE descendants(id) AS (
+					SELECT replies.id FROM posts AS replies WHERE replies.parent_id = posts.id
+					UNION ALL
+					SELECT replies.id FROM posts AS replies INNER JOIN descendants ON replies.parent_id = descendants.id
+				)
+				SELECT COUNT(*) FROM descendants
+			) AS reply_count,
+			posts.created_at,
+			posts.edited_at
+		FROM posts
+		WHERE posts.parent_id IS NULL
+		  AND posts.deleted_at IS NULL
+		  AND ` + where
+
+	order := "DESC"
+	if page.Before > 0 {
+		query += " AND (posts.created_at, posts.id) < (SELECT created_at, id FROM posts WHERE id = ?)"
+		args = append(args, page.Before)
+	} else if page.After > 0 {
+		// walk forwards from the cursor, flipped back to newest first below
+		query += " AND (posts.created_at, posts.id) > (SELECT created_at, id FROM posts WHERE id = ?)"
+		args = append(args, page.After)
+		order = "ASC"
+	}
+
+	// one extra row tells us if there's another page
+	query += " ORDER BY posts.created_at " + order + ", posts.id " + order + " LIMIT ?"
+	args = append(args, page.Limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, Pagination{}, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var post Post
+		if err := rows.Scan(&post.ID, &post.Content, &post.contentHTML, &post.Username, &post.Likes, &post.ReplyCount, &post.CreatedAt, &post.EditedAt); err != nil {
+			log.Println("Scan error:", err)
+			continue
+		}
+		posts = append(posts, post)
+	}
+	rows.Close() // free the connection before the tag query
+
+	hasMore := len(posts) > page.Limit
+	if hasMore {
+		posts = posts[:page.Limit]
+	}
+
+	// tags and media for the whole page, one query each
+	attachPostTags(posts)
+	attachPostMedia(posts)
+
+	if page.After > 0 {
+		for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+			posts[i], posts[j] = posts[j], posts[i]
+		}
+	}
+
+	var pagination Pagination
+	if len(posts) > 0 {
+		newest, oldest := posts[0].ID, posts[len(posts)-1].ID
+		if page.After > 0 {
+			// the cursor post itself is older than this page
+			pagination.OlderCursor = oldest
+			if hasMore {
+				pagination.NewerCursor = newest
+			}
+		} else {
+			if hasMore {
+				pagination.OlderCursor = oldest
+			}
+			if page.Before > 0 {
+				pagination.NewerCursor = newest
+			}
+		}
+	}
+	return posts, pagination, nil
+}
@@ -4,51 +4,74 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
-	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type Post struct {
-	ID         int
-	Content    string
-	Username   string
-	ImageURL   string
-	Likes      int
-	ReplyCount int
-	CreatedAt  string
-	Tags       []string
-	ParentID   *int
-	Replies    []Post
-	PostType   string
+	ID         int      `json:"id"`
+	Content    string   `json:"content"`
+	Username   string   `json:"username"`
+	Media      []Media  `json:"media,omitempty"`
+	Likes      int      `json:"likes"`
+	ReplyCount int      `json:"reply_count"`
+	CreatedAt  string   `json:"created_at"`
+	EditedAt   *string  `json:"edited_at,omitempty"`
+	Deleted    bool     `json:"deleted,omitempty"`
+	Tags       []string `json:"tags"`
+	ParentID   *int     `json:"parent_id,omitempty"`
+	Replies    []Post   `json:"replies,omitempty"`
+	PostType   string   `json:"post_type,omitempty"`
+
+	contentHTML string // rendered when the post was written, see ContentHTML
+}
+
+// longest post content accepted, in characters (TERRACOTTA_MAX_POST_LENGTH)
+var maxPostLength = envInt("TERRACOTTA_MAX_POST_LENGTH", 10000)
+
+var errPostTooLong = fmt.Errorf("posts can be at most %d characters", maxPostLength)
+
+// errPostTooLong if the content is over maxPostLength
+func checkPostLength(content string) error {
+	if utf8.RuneCountInString(content) > maxPostLength {
+		return errPostTooLong
+	}
+	return nil
 }
 
 type PageData struct {
-	Username string
-	Posts    []Post
-	Post     *Post // individual post view
+	Username   string         `json:"username"`
+	CSRFToken  string         `json:"-"`
+	Posts      []Post         `json:"posts,omitempty"`
+	Post       *Post          `json:"post,omitempty"` // individual post view
+	Pagination *Pagination    `json:"pagination,omitempty"`
+	ReplyTags  bool           `json:"-"` // the reply form has a tags field
+	Trending   *TrendingTags  `json:"-"`
+	TimeZone   *time.Location `json:"-"` // timestamps are shown in it
 }
 
 type DayGroup struct {
-	DayNumber int
-	Date      string
-	Posts     []Post
+	DayNumber int    `json:"day_number"`
+	Date      string `json:"date"`
+	Posts     []Post `json:"posts"`
 }
 
-type JournalPageData struct {
-	Username  string
-	DayGroups []DayGroup
+type Tag struct {
+	Name        string `json:"name"`
+	PostCount   int    `json:"post_count"`
+	RecentCount int    `json:"recent_count"` // posts in the last week
+	LastPostAt  string `json:"last_post_at"`
 }
 
-const NEIGHBORHOOD_START_DATE = "2025-06-01"
-
 // Helper functions for image handling
+// contentType should come from sniffing the file, not from the client
 func isValidImage(contentType string) bool {
 	validTypes := map[string]bool{
 		"image/jpeg": true,
@@ -60,8 +83,8 @@ func isValidImage(contentType string) bool {
 	return validTypes[contentType]
 }
 
-func generateUniqueFilename(originalFilename string) string {
-	ext := filepath.Ext(originalFilename)
+// random file name with the given extension (ext includes the dot)
+func generateUniqueFilename(ext string) string {
 	randBytes := make([]byte, 16)
 	rand.Read(randBytes)
 	return hex.EncodeToString(randBytes) + ext
@@ -69,45 +92,20 @@ func generateUniqueFilename(originalFilename string) string {
 
 // index handler - timeline (exclude journal posts)
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query(`
-		SELECT
-			posts.id,
-			posts.content,
-			posts.username,
-			posts.image_url,
-			COUNT(DISTINCT likes.id) AS likes,
-			COUNT(DISTINCT replies.id) AS reply_count,
-			posts.created_at
-		FROM posts
-		LEFT JOIN likes ON posts.id = likes.post_id
-		LEFT JOIN posts AS replies ON posts.id = replies.parent_id
-		WHERE posts.parent_id IS NULL
-		  AND (posts.post_type IS NULL OR posts.post_type != 'journal')
-		GROUP BY posts.id
-		ORDER BY posts.created_at DESC
-	`)
+	posts, pagination, err := getTimelinePosts(pageRequestFromQuery(r))
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	defer rows.Close()
-
-	var posts []Post
-	for rows.Next() {
-		var post Post
-		if err := rows.Scan(&post.ID, &post.Content, &post.Username, &post.ImageURL, &post.Likes, &post.ReplyCount, &post.CreatedAt); err != nil {
-			log.Println("Scan error:", err)
-			continue
-		}
-
-		// fetch tags for the post
-		post.Tags = getPostTags(post.ID)
-		posts = append(posts, post)
-	}
 
+	trending := getTrendingTags(r.URL.Query().Get("trending"))
 	data := PageData{
-		Username: getUsername(r),
-		Posts:    posts,
+		Username:   getUsername(r),
+		CSRFToken:  csrfToken(w, r),
+		Posts:      posts,
+		Pagination: &pagination,
+		Trending:   &trending,
+		TimeZone:   viewerLocation(r, time.UTC),
 	}
 	templates.ExecuteTemplate(w, "index.html", data)
 }
@@ -126,24 +124,7 @@ func postThreadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// gets main post
-	var post Post
-	err = db.QueryRow(`
-		SELECT
-			posts.id,
-			posts.content,
-			posts.username,
-			posts.image_url,
-			COUNT(DISTINCT likes.id) AS likes,
-			COUNT(DISTINCT replies.id) AS reply_count,
-			posts.created_at
-		FROM posts
-		LEFT JOIN likes ON posts.id = likes.post_id
-		LEFT JOIN posts AS replies ON posts.id = replies.parent_id
-		WHERE posts.id = ?
-		GROUP BY posts.id
-	`, postID).Scan(&post.ID, &post.Content, &post.Username, &post.ImageURL, &post.Likes, &post.ReplyCount, &post.CreatedAt)
-
+	post, err := getPost(postID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Post not found", 404)
@@ -153,15 +134,12 @@ func postThreadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// get tags for the main post
-	post.Tags = getPostTags(post.ID)
-
-	// gets replies
-	post.Replies = getPostReplies(postID)
-
 	data := PageData{
-		Username: getUsername(r),
-		Post:     &post,
+		Username:  getUsername(r),
+		CSRFToken: csrfToken(w, r),
+		Post:      post,
+		ReplyTags: replyTagsEnabled,
+		TimeZone:  viewerLocation(r, time.UTC),
 	}
 	templates.ExecuteTemplate(w, "thread.html", data)
 }
@@ -173,8 +151,8 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username := getUsername(r)
-	if username == "" {
+	userID, username, ok := getAuthUser(r, scopeWrite)
+	if !ok {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
@@ -184,29 +162,13 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing content", 400)
 		return
 	}
-
-	// image upload
-	var imageURL string
-	file, handler, fileErr := r.FormFile("image")
-	if fileErr == nil {
-		defer file.Close()
-
-		if isValidImage(handler.Header.Get("Content-Type")) {
-			filename := generateUniqueFilename(handler.Filename)
-
-			// Create uploads directory if it doesn't exist
-			err := os.MkdirAll("./uploads", 0755)
-			if err != nil {
-				log.Printf("Error creating uploads directory: %v", err)
-			} else {
-				dst, err := os.Create("./uploads/" + filename)
-				if err == nil {
-					defer dst.Close()
-					io.Copy(dst, file)
-					imageURL = "/uploads/" + filename // set image URL for post
-				}
-			}
-		}
+	if err := checkPostLength(content); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if _, err := normalizeTags(parseTags(r.FormValue("tags"))); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
 	}
 
 	// JOURNAL: determine post type
@@ -215,6 +177,26 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
 		postType = "regular" //default
 	}
 
+	// journal posts go to the journal in the form, or the default one
+	var journal Journal
+	var journalID *int
+	if postType == "journal" {
+		var err error
+		if journal, err = openJournal(r.FormValue("journal"), username); err != nil {
+			http.Error(w, err.Error(), journalErrorStatus(err))
+			return
+		}
+		journalID = &journal.ID
+	}
+
+	// image upload
+	media, err := saveUploadedMedia(r, userID)
+	if err != nil {
+		status, message := imageErrorStatus(err)
+		http.Error(w, message, status)
+		return
+	}
+
 	// check if this is a reply
 	var parentID *int
 	if parentIDStr := r.FormValue("parent_id"); parentIDStr != "" {
@@ -222,42 +204,41 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
 			parentID = &pid
 		}
 	}
+	if !canHaveTags(parentID) && len(parseTags(r.FormValue("tags"))) > 0 {
+		http.Error(w, errReplyTags.Error(), 400)
+		return
+	}
 
-	// insert the post (now w/ image_url)
-	var result sql.Result
-	var err error
+	// no replying to deleted posts
 	if parentID != nil {
-		result, err = db.Exec("INSERT INTO posts (username, content, image_url, parent_id, post_type) VALUES (?, ?, ?, ?, ?)", username, content, imageURL, *parentID, postType)
-	} else {
-		result, err = db.Exec("INSERT INTO posts (username, content, image_url, post_type) VALUES (?, ?, ?, ?)", username, content, imageURL, postType)
+		var exists int
+		err := db.QueryRow("SELECT 1 FROM posts WHERE id = ? AND deleted_at IS NULL", *parentID).Scan(&exists)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Post not found", 404)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
 	}
 
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	_, err = createPost(username, content, media, postType, journalID, parentID, r.FormValue("tags"))
+	var badAttachment attachmentError
+	if errors.As(err, &badAttachment) {
+		http.Error(w, err.Error(), 400)
 		return
-	}
-
-	postID, err := result.LastInsertId()
-	if err != nil {
-		http.Error(w, "Failed to retrieve postID", 500)
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	// handle tags (main posts only)
-	if parentID == nil {
-		tagList := r.FormValue("tags")
-		if tagList != "" {
-			insertPostTags(int(postID), tagList)
-		}
-	}
-
 	// redirect (based on post type)
 	if parentID != nil {
 		// reply -> thread
 		http.Redirect(w, r, "/thread?id="+strconv.Itoa(*parentID), http.StatusSeeOther)
 	} else if postType == "journal" {
 		// journal -> journal
-		http.Redirect(w, r, "/journal", http.StatusSeeOther)
+		http.Redirect(w, r, journal.Path(), http.StatusSeeOther)
 	} else {
 		// regular -> home
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -271,95 +252,278 @@ func likePostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username := getUsername(r)
-	if username == "" {
+	userID, _, ok := getAuthUser(r, scopeWrite)
+	if !ok {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	postID := r.FormValue("post_id")
-	if postID == "" {
+	postIDStr := r.FormValue("post_id")
+	if postIDStr == "" {
 		http.Error(w, "Missing post ID", http.StatusBadRequest)
 		return
 	}
 
-	var userID int
-	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	postID, err := strconv.Atoi(postIDStr)
 	if err != nil {
-		http.Error(w, "User not found", 500)
+		http.Error(w, "Invalid post ID", http.StatusBadRequest)
 		return
 	}
 
-	// check if the user has already liked the post
+	if _, err := toggleLike(userID, postID); err == sql.ErrNoRows {
+		http.Error(w, "Post not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to toggle like", 500)
+		return
+	}
+
+	// redirect back to appropriate page
+	redirectURL := r.FormValue("redirect")
+	if redirectURL == "" {
+		redirectURL = "/"
+	}
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// helper functions
+
+// a page of top-level timeline posts, newest first (excludes journal posts)
+func getTimelinePosts(page PageRequest) ([]Post, Pagination, error) {
+	return getFeedPosts("(posts.post_type IS NULL OR posts.post_type != 'journal')", page)
+}
+
+// a single post with its tags and replies, sql.ErrNoRows if it doesn't exist
+func getPost(postID int) (*Post, error) {
+	var post Post
+	err := db.QueryRow(`
+		SELECT
+			posts.id,
+			posts.content,
+			COALESCE(posts.content_html, ''),
+			posts.username,
+			(SELECT COUNT(*) FROM likes WHERE likes.post_id = posts.id) AS likes,
+			posts.created_at,
+			posts.edited_at,
+			posts.deleted_at IS NOT NULL,
+			posts.parent_id,
+			COALESCE(posts.post_type, 'regular')
+		FROM posts
+		WHERE posts.id = ?
+	`, postID).Scan(&post.ID, &post.Content, &post.contentHTML, &post.Username, &post.Likes, &post.CreatedAt, &post.EditedAt, &post.Deleted, &post.ParentID, &post.PostType)
+	if err != nil {
+		return nil, err
+	}
+
+	// gets the whole reply tree
+	post.Replies = getPostReplies(postID)
+	post.ReplyCount = countReplies(post.Replies)
+
+	// tags and media for the post and every reply, one query each
+	ids := []int{post.ID}
+	walkReplies(post.Replies, func(reply *Post) {
+		ids = append(ids, reply.ID)
+	})
+	tagsByPost := loadPostTags(ids)
+	mediaByPost := loadPostMedia(ids)
+	post.Tags = tagsByPost[post.ID]
+	post.Media = mediaByPost[post.ID]
+
+	// deleted posts only keep their place in the thread
+	if post.Deleted {
+		post.tombstone()
+	}
+	walkReplies(post.Replies, func(reply *Post) {
+		reply.Tags = tagsByPost[reply.ID]
+		reply.Media = mediaByPost[reply.ID]
+		if reply.Deleted {
+			reply.tombstone()
+		}
+	})
+	return &post, nil
+}
+
+// inserts a post or reply with its media and returns its id. tags only apply
+// to replies when replyTagsEnabled. journalID is the journal a journal post
+// goes to, nil for other posts
+func createPost(username, content string, media []Media, postType string, journalID *int, parentID *int, tagList string) (int, error) {
+	if err := checkPostLength(content); err != nil {
+		return 0, err
+	}
+
+	// the post goes in with its media, tags and mentions or not at all
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// insert the post, rendered once here rather than on every view
+	result, err := tx.Exec("INSERT INTO posts (username, content, content_html, parent_id, post_type, journal_id) VALUES (?, ?, ?, ?, ?, ?)", username, content, string(renderMarkdown(content)), parentID, postType, journalID)
+	if err != nil {
+		return 0, err
+	}
+
+	postID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := insertPostMedia(tx, int(postID), media); err != nil {
+		return 0, err
+	}
+
+	// handle tags
+	if canHaveTags(parentID) {
+		if err := insertPostTags(tx, int(postID), parseTags(tagList)); err != nil {
+			return 0, err
+		}
+	}
+
+	// mentions, and hashtags in the content
+	if err := savePostRefs(tx, int(postID), content, canHaveTags(parentID)); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(postID), nil
+}
+
+// likes or unlikes the post, returns whether it's liked afterwards.
+// sql.ErrNoRows if the post doesn't exist or was deleted
+func toggleLike(userID, postID int) (bool, error) {
+	// deleted posts can't be liked, or unliked
 	var exists int
+	err := db.QueryRow("SELECT 1 FROM posts WHERE id = ? AND deleted_at IS NULL", postID).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	// check if the user has already liked the post
 	err = db.QueryRow("SELECT 1 FROM likes WHERE user_id = ? AND post_id = ?", userID, postID).Scan(&exists)
 	if err == nil {
 		// unlike the post
 		_, err = db.Exec("DELETE FROM likes WHERE user_id = ? AND post_id = ?", userID, postID)
-		if err != nil {
-			http.Error(w, "Failed to unlike post", 500)
-			return
-		}
+		return false, err
 	} else if err == sql.ErrNoRows {
 		// like the post
 		_, err = db.Exec("INSERT INTO likes (user_id, post_id) VALUES (?, ?)", userID, postID)
-		if err != nil {
-			http.Error(w, "Failed to like post", 500)
-			return
-		}
-	} else {
-		http.Error(w, "Database error", 500)
-		return
+		return true, err
+	}
+	return false, err
+}
+
+// every tag in use, sorted "popular" (most posts first) or "recent" (most
+// recently used first)
+func getAllTags(sort string) ([]Tag, error) {
+	order := "post_count DESC, tags.name ASC"
+	if sort == "recent" {
+		order = "last_post_at DESC, tags.name ASC"
 	}
 
-	// redirect back to appropriate page
-	redirectURL := r.FormValue("redirect")
-	if redirectURL == "" {
-		redirectURL = "/"
+	rows, err := db.Query(`
+		SELECT
+			tags.name,
+			COUNT(post_tags.post_id) AS post_count,
+			SUM(posts.created_at > datetime('now', ?)) AS recent_count,
+			MAX(posts.created_at) AS last_post_at
+		FROM tags
+		INNER JOIN post_tags ON tags.id = post_tags.tag_id
+		INNER JOIN posts ON posts.id = post_tags.post_id
+		WHERE posts.deleted_at IS NULL
+		GROUP BY tags.id
+		ORDER BY `+order, recentTagWindow)
+	if err != nil {
+		return nil, err
 	}
-	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.Name, &tag.PostCount, &tag.RecentCount, &tag.LastPostAt); err != nil {
+			log.Printf("Error scanning tag: %v", err)
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
 }
 
-// helper functions
+// loads the tags for all the given posts in one query, keyed by post id
+func loadPostTags(postIDs []int) map[int][]string {
+	tagsByPost := make(map[int][]string)
+	if len(postIDs) == 0 {
+		return tagsByPost
+	}
+
+	ids := make([]any, len(postIDs))
+	for i, id := range postIDs {
+		ids[i] = id
+	}
+	placeholders := strings.Repeat("?,", len(ids))
+	placeholders = placeholders[:len(placeholders)-1]
 
-func getPostTags(postID int) []string {
 	rows, err := db.Query(`
-		SELECT tags.name
+		SELECT post_tags.post_id, tags.name
 		FROM post_tags
 		INNER JOIN tags ON post_tags.tag_id = tags.id
-		WHERE post_tags.post_id = ?`, postID)
+		WHERE post_tags.post_id IN (`+placeholders+`)
+		ORDER BY post_tags.id`, ids...)
 	if err != nil {
-		log.Printf("Error fetching tags for post %d: %v", postID, err)
-		return nil
+		log.Printf("Error fetching tags for posts: %v", err)
+		return tagsByPost
 	}
 	defer rows.Close()
 
-	var tags []string
 	for rows.Next() {
+		var postID int
 		var tag string
-		if err := rows.Scan(&tag); err != nil {
+		if err := rows.Scan(&postID, &tag); err != nil {
 			log.Printf("Error scanning tag: %v", err)
 			continue
 		}
-		tags = append(tags, tag)
+		tagsByPost[postID] = append(tagsByPost[postID], tag)
 	}
-	return tags
+	return tagsByPost
 }
 
+// fills in Tags for a batch of posts with a single query
+func attachPostTags(posts []Post) {
+	ids := make([]int, len(posts))
+	for i, post := range posts {
+		ids[i] = post.ID
+	}
+
+	tagsByPost := loadPostTags(ids)
+	for i := range posts {
+		posts[i].Tags = tagsByPost[posts[i].ID]
+	}
+}
+
+// every reply under the post, however deep, as a tree. each reply's
+// ReplyCount counts all of its descendants
 func getPostReplies(postID int) []Post {
 	rows, err := db.Query(`
+		WITH RECURSIVE thread(id) AS (
+			SELECT id FROM posts WHERE parent_id = ?
+			UNION ALL
+			SELECT posts.id FROM posts INNER JOIN thread ON posts.parent_id = thread.id
+		)
 		SELECT
 			posts.id,
+			posts.parent_id,
 			posts.content,
+			COALESCE(posts.content_html, ''),
 			posts.username,
-			posts.image_url,
-			COUNT(DISTINCT likes.id) AS likes,
-			posts.created_at
-		FROM posts
-		LEFT JOIN likes ON posts.id = likes.post_id
-		WHERE posts.parent_id = ?
-		GROUP BY posts.id
-		ORDER BY posts.created_at ASC
+			(SELECT COUNT(*) FROM likes WHERE likes.post_id = posts.id) AS likes,
+			posts.created_at,
+			posts.edited_at,
+			posts.deleted_at IS NOT NULL
+		FROM thread
+		INNER JOIN posts ON posts.id = thread.id
+		ORDER BY posts.created_at ASC, posts.id ASC
 	`, postID)
 	if err != nil {
 		log.Printf("Error fetching replies for post %d: %v", postID, err)
@@ -370,50 +534,41 @@ func getPostReplies(postID int) []Post {
 	var replies []Post
 	for rows.Next() {
 		var reply Post
-		if err := rows.Scan(&reply.ID, &reply.Content, &reply.Username, &reply.ImageURL, &reply.Likes, &reply.CreatedAt); err != nil {
+		if err := rows.Scan(&reply.ID, &reply.ParentID, &reply.Content, &reply.contentHTML, &reply.Username, &reply.Likes, &reply.CreatedAt, &reply.EditedAt, &reply.Deleted); err != nil {
 			log.Printf("Error scanning reply: %v", err)
 			continue
 		}
 		replies = append(replies, reply)
 	}
-	return replies
+	return buildReplyTree(postID, replies)
 }
 
-func insertPostTags(postID int, tagList string) {
-	if tagList == "" {
-		return
-	}
-
-	tags := parseTags(tagList)
+// adds the tags to the post. names are normalized and aliases resolved
+// first, invalid ones are skipped, handlers check them with normalizeTags
+func insertPostTags(tx *sql.Tx, postID int, tags []string) error {
 	for _, tagName := range tags {
-		tagName = strings.TrimSpace(tagName)
-		if tagName == "" {
+		tagName, err := resolveTag(tx, tagName)
+		if err != nil {
+			log.Printf("Skipping tag for post %d: %v", postID, err)
 			continue
 		}
 
+		// find or create the tag
+		if _, err := tx.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", tagName); err != nil {
+			return err
+		}
 		var tagID int
-		// try to find existing tag
-		err := db.QueryRow("SELECT id FROM tags WHERE name = ?", tagName).Scan(&tagID)
-		if err == sql.ErrNoRows {
-			// if tag doesn't exist, create it
-			result, err := db.Exec("INSERT INTO tags (name) VALUES (?)", tagName)
-			if err != nil {
-				log.Printf("Failed to insert tag '%s': %v", tagName, err)
-				continue
-			}
-			tagID64, _ := result.LastInsertId()
-			tagID = int(tagID64)
-		} else if err != nil {
-			log.Printf("Failed to query tag '%s': %v", tagName, err)
-			continue
+		if err := tx.QueryRow("SELECT id FROM tags WHERE name = ?", tagName).Scan(&tagID); err != nil {
+			return err
 		}
 
-		// associate the tag with the post
-		_, err = db.Exec("INSERT INTO post_tags (post_id, tag_id) VALUES (?, ?)", postID, tagID)
+		// associate the tag with the post, once
+		_, err = tx.Exec("INSERT OR IGNORE INTO post_tags (post_id, tag_id) VALUES (?, ?)", postID, tagID)
 		if err != nil {
-			log.Printf("Failed to associate tag '%s' with post: %v", tagName, err)
+			return err
 		}
 	}
+	return nil
 }
 
 // helper for parsing comma separated tags
@@ -431,124 +586,53 @@ func parseTags(tags string) []string {
 	return result
 }
 
-// Journal handler
-// Fixed journalHandler with complete data and proper day grouping
-func journalHandler(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query(`
-		SELECT
-			posts.id,
-			posts.content,
-			posts.username,
-			posts.image_url,
-			COUNT(DISTINCT likes.id) AS likes,
-			COUNT(DISTINCT replies.id) AS reply_count,
-			posts.created_at
-		FROM posts
-		LEFT JOIN likes ON posts.id = likes.post_id
-		LEFT JOIN posts AS replies ON posts.id = replies.parent_id
-		WHERE posts.parent_id IS NULL
-		  AND posts.post_type = 'journal'
-		GROUP BY posts.id
-		ORDER BY posts.created_at DESC
-	`)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	defer rows.Close()
-
-	var posts []Post
-	for rows.Next() {
-		var post Post
-		if err := rows.Scan(
-			&post.ID, &post.Content, &post.Username, &post.ImageURL,
-			&post.Likes, &post.ReplyCount, &post.CreatedAt); err != nil {
-			log.Println("Scan error:", err)
-			continue
-		}
-		post.Tags = getPostTags(post.ID)
-		posts = append(posts, post)
-	}
-
-	// Fixed: group posts by day with proper error handling
-	dayGroups := groupPostsByDayFixed(posts)
-
-	data := JournalPageData{
-		Username:  getUsername(r),
-		DayGroups: dayGroups,
-	}
-	templates.ExecuteTemplate(w, "journal.html", data)
-}
-
-// Fixed version of groupPostsByDay function
-func groupPostsByDayFixed(posts []Post) []DayGroup {
-	if len(posts) == 0 {
-		return nil
-	}
-
-	dayMap := make(map[int][]Post)
-
+// groups the journal's posts by the day they were posted, newest first.
+// the day is the date where the author was (see timezone.go), and day
+// numbers count from the journal's start date
+func groupPostsByDayFixed(journal Journal, posts []Post) []DayGroup {
+	var usernames []string
 	for _, post := range posts {
-		dayNumber := getDayNumberFixed(post.CreatedAt)
-		log.Printf("DEBUG: Post ID %d, Created: %s, Day: %d", post.ID, post.CreatedAt, dayNumber)
-		if dayNumber > 0 {
-			dayMap[dayNumber] = append(dayMap[dayNumber], post)
-		}
-	}
-
-	// Create day groups in descending order (newest first)
-	var dayGroups []DayGroup
-	maxDay := getMaxDay(dayMap)
-	for day := maxDay; day >= 1; day-- {
-		if posts, exists := dayMap[day]; exists {
-			dayGroups = append(dayGroups, DayGroup{
-				DayNumber: day,
-				Date:      formatDayDate(day),
-				Posts:     posts,
-			})
+		if !slices.Contains(usernames, post.Username) {
+			usernames = append(usernames, post.Username)
 		}
 	}
-
-	return dayGroups
-}
-
-// Fixed getDayNumber function with better error handling
-func getDayNumberFixed(createdAt string) int {
-	// Parse neighborhood start date
-	startDate, err := time.Parse("2006-01-02", NEIGHBORHOOD_START_DATE)
+	authorLocations, err := userLocations(usernames)
 	if err != nil {
-		log.Printf("Error parsing neighborhood start date: %v", err)
-		return 0
+		log.Printf("Error loading time zones: %v", err)
 	}
 
-	// Try multiple date formats for parsing
-	var postDate time.Time
-
-	// Try SQLite default format first
-	postDate, err = time.Parse("2006-01-02 15:04:05", createdAt)
-	if err != nil {
-		// Try RFC3339 format
-		postDate, err = time.Parse(time.RFC3339, createdAt)
+	var dayGroups []DayGroup
+	groupIndex := make(map[int]int) // day number -> index in dayGroups
+	for _, post := range posts {
+		createdAt, err := parseTimestamp(post.CreatedAt)
 		if err != nil {
-			// Try just the date part
-			postDate, err = time.Parse("2006-01-02", createdAt[:10])
-			if err != nil {
-				log.Printf("Error parsing post created_at date '%s': %v", createdAt, err)
-				return 0
-			}
+			log.Printf("Error parsing post created_at date '%s': %v", post.CreatedAt, err)
+			continue
 		}
-	}
-
-	// Calculate difference in days
-	diff := postDate.Sub(startDate)
-	dayNum := int(diff.Hours()/24) + 1
-
-	// Ensure day number is positive
-	if dayNum < 1 {
-		dayNum = 1
-	}
+		loc, ok := authorLocations[post.Username]
+		if !ok {
+			loc = journal.Location()
+		}
+		createdAt = createdAt.In(loc)
 
-	return dayNum
+		day := journal.DayNumber(createdAt)
+		if i, ok := groupIndex[day]; ok {
+			dayGroups[i].Posts = append(dayGroups[i].Posts, post)
+			continue
+		}
+		groupIndex[day] = len(dayGroups)
+		dayGroups = append(dayGroups, DayGroup{
+			DayNumber: day,
+			Date:      createdAt.Format("January 2, 2006"),
+			Posts:     []Post{post},
+		})
+	}
+
+	// authors in different zones can put posts a little out of day order
+	slices.SortStableFunc(dayGroups, func(a, b DayGroup) int {
+		return b.DayNumber - a.DayNumber
+	})
+	return dayGroups
 }
 
 // journal post handler
@@ -558,8 +642,8 @@ func journalPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username := getUsername(r)
-	if username == "" {
+	userID, username, ok := getAuthUser(r, scopeWrite)
+	if !ok {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
@@ -569,171 +653,95 @@ func journalPostHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing content", 400)
 		return
 	}
-
-	// Handle image upload for journal posts
-	var imageURL string
-	file, handler, fileErr := r.FormFile("image")
-	if fileErr == nil {
-		defer file.Close()
-
-		if isValidImage(handler.Header.Get("Content-Type")) {
-			filename := generateUniqueFilename(handler.Filename)
-
-			// Create uploads directory if it doesn't exist
-			err := os.MkdirAll("./uploads", 0755)
-			if err != nil {
-				log.Printf("Error creating uploads directory: %v", err)
-			} else {
-				dst, err := os.Create("./uploads/" + filename)
-				if err == nil {
-					defer dst.Close()
-					io.Copy(dst, file)
-					imageURL = "/uploads/" + filename
-				}
-			}
-		}
-	}
-
-	// Insert journal post
-	result, err := db.Exec("INSERT INTO posts (username, content, image_url, post_type) VALUES (?, ?, ?, 'journal')", username, content, imageURL)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	if err := checkPostLength(content); err != nil {
+		http.Error(w, err.Error(), 400)
 		return
 	}
-
-	postID, err := result.LastInsertId()
-	if err != nil {
-		http.Error(w, "Failed to retrieve postID", 500)
+	if _, err := normalizeTags(parseTags(r.FormValue("tags"))); err != nil {
+		http.Error(w, err.Error(), 400)
 		return
 	}
 
-	//Handler for journal post tags
-	tagList := r.FormValue("tags")
-	if tagList != "" {
-		insertPostTags(int(postID), tagList)
-	}
-
-	http.Redirect(w, r, "/journal", http.StatusSeeOther)
-}
-
-func groupPostsByDay(posts []Post) []DayGroup {
-	if len(posts) == 0 {
-		return nil
-	}
-
-	dayMap := make(map[int][]Post)
-
-	for _, post := range posts {
-		dayNumber := getDayNumber(post.CreatedAt)
-		if dayNumber > 0 {
-			dayMap[dayNumber] = append(dayMap[dayNumber], post)
-		}
-	}
-
-	var dayGroups []DayGroup
-	for day := 1; day <= getMaxDay(dayMap); day++ {
-		if posts, exists := dayMap[day]; exists {
-			dayGroups = append(dayGroups, DayGroup{
-				DayNumber: day,
-				Date:      formatDayDate(day),
-				Posts:     posts,
-			})
-		}
-	}
-
-	return dayGroups
-}
-
-func getDayNumber(createdAt string) int {
-	// parse neighborhood start date
-	startDate, err := time.Parse("2006-01-02", NEIGHBORHOOD_START_DATE)
+	// the journal in the form, or the default one
+	journal, err := openJournal(r.FormValue("journal"), username)
 	if err != nil {
-		log.Println("Error parsing neighborhood start date: %v", err)
-		return 0
+		http.Error(w, err.Error(), journalErrorStatus(err))
+		return
 	}
 
-	// parse post created_at date
-	postDate, err := time.Parse("2006-01-02 15:04:05", createdAt)
+	// Handle image upload for journal posts
+	media, err := saveUploadedMedia(r, userID)
 	if err != nil {
-		log.Println("Error parsing post created_at date: %v", err)
-		return 0
+		status, message := imageErrorStatus(err)
+		http.Error(w, message, status)
+		return
 	}
 
-	//calculate difference in days
-	diff := postDate.Sub(startDate)
-	dayNum := int(diff.Hours() / 24) + 1
-
-	return dayNum
-}
-
-func getMaxDay(dayMap map[int][]Post) int {
-	max := 0
-	for day := range dayMap {
-		if day > max {
-			max = day
-		}
+	// Insert journal post (with its tags and images)
+	_, err = createPost(username, content, media, "journal", &journal.ID, nil, r.FormValue("tags"))
+	var badAttachment attachmentError
+	if errors.As(err, &badAttachment) {
+		http.Error(w, err.Error(), 400)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
 	}
-	return max
-}
 
-func formatDayDate(dayNum int) string {
-	startDate, _ := time.Parse("2006-01-02", NEIGHBORHOOD_START_DATE)
-	targetDate := startDate.AddDate(0, 0, dayNum-1)
-	return targetDate.Format("January 2, 2006")
+	http.Redirect(w, r, journal.Path(), http.StatusSeeOther)
 }
 
-// image handler - you can remove this if you don't need a separate endpoint
+// POST /api/v1/media - uploads an image ahead of its post. it's kept as
+// pending media until a post attaches it by id (media_id in forms, "media"
+// in the json api), or until it expires
 func UploadImageHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	userID, _, ok := getAuthUser(r, scopeWrite)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
 		return
 	}
 
-	// Parse the multipart form (32MB limit)
-	err := r.ParseMultipartForm(32 << 20)
-	if err != nil {
-		http.Error(w, "File too large", http.StatusBadRequest)
+	file, _, err := r.FormFile("image")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		status, message := imageErrorStatus(err)
+		writeJSONError(w, status, message)
 		return
-	}
-
-	file, handler, err := r.FormFile("image")
-	if err != nil {
-		http.Error(w, "Error retrieving file", http.StatusBadRequest)
+	} else if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "missing image file")
 		return
 	}
 	defer file.Close()
 
-	// check file type
-	if !isValidImage(handler.Header.Get("Content-Type")) {
-		http.Error(w, "Invalid file type", http.StatusBadRequest)
-		return
-	}
-
-	// generate a unique filename
-	filename := generateUniqueFilename(handler.Filename)
-
-	// Create uploads directory if it doesn't exist
-	err = os.MkdirAll("./uploads", 0755)
+	// check it's really an image and re-encode it
+	processed, err := processImage(file)
 	if err != nil {
-		http.Error(w, "Cannot create uploads directory", http.StatusInternalServerError)
+		status, message := imageErrorStatus(err)
+		writeJSONError(w, status, message)
 		return
 	}
 
-	// save the file to the server
-	dst, err := os.Create("./uploads/" + filename)
+	// save the file (and its resized variants)
+	image, err := storeImage(processed)
 	if err != nil {
-		http.Error(w, "Cannot create file", http.StatusInternalServerError)
+		status, message := imageErrorStatus(err)
+		writeJSONError(w, status, message)
 		return
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, file)
+	mediaID, err := createPendingMedia(userID, image)
 	if err != nil {
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// return filename for frontend use
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"filename": filename})
+	writeJSON(w, http.StatusCreated, pendingMediaResponse{
+		ID:        mediaID,
+		Filename:  strings.TrimPrefix(image.URL, "/uploads/"),
+		URL:       image.URL,
+		ThumbURL:  image.ThumbURL,
+		MediumURL: image.MediumURL,
+		Width:     image.Width,
+		Height:    image.Height,
+	})
 }
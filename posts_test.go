@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"slices"
+	"testing"
+)
+
+func TestToggleLike(t *testing.T) {
+	openTestDB(t)
+	if _, err := db.Exec("INSERT INTO users (id, username, password_hash) VALUES (1, 'alice', '')"); err != nil {
+		t.Fatal(err)
+	}
+	postID, err := createPost("alice", "hello", nil, "regular", nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []bool{true, false, true} {
+		if liked, err := toggleLike(1, postID); err != nil || liked != want {
+			t.Fatalf("toggleLike = %v, %v, want %v", liked, err, want)
+		}
+	}
+
+	if _, err := db.Exec("UPDATE posts SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?", postID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := toggleLike(1, postID); err != sql.ErrNoRows {
+		t.Errorf("toggleLike on a deleted post = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := toggleLike(1, postID+1); err != sql.ErrNoRows {
+		t.Errorf("toggleLike on a missing post = %v, want sql.ErrNoRows", err)
+	}
+}
+
+// a journal post's day is its date where the author was, or in the
+// journal's zone for authors who haven't picked one
+func TestGroupPostsByDayFixed(t *testing.T) {
+	openTestDB(t)
+	_, err := db.Exec(`INSERT INTO users (username, password_hash, time_zone) VALUES
+		('kiri', '', 'Pacific/Kiritimati'),
+		('ana', '', 'America/Los_Angeles'),
+		('noone', '', NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal := Journal{Slug: "test", StartDate: "2026-03-01", TimeZone: "Europe/Berlin"}
+
+	// newest first, like the feed loads them
+	posts := []Post{
+		{ID: 6, Username: "ana", CreatedAt: "2026-03-09 07:30:00"},   // march 9, 00:30 PDT
+		{ID: 5, Username: "ana", CreatedAt: "2026-03-09 06:30:00"},   // march 8, 23:30 PDT
+		{ID: 4, Username: "kiri", CreatedAt: "2026-03-02 10:00:00"},  // march 3, 00:00
+		{ID: 3, Username: "noone", CreatedAt: "2026-03-01 23:30:00"}, // march 2, 00:30 in Berlin
+		{ID: 2, Username: "kiri", CreatedAt: "2026-03-01 09:00:00"},  // march 1, 23:00
+		{ID: 1, Username: "ana", CreatedAt: "2026-03-01 09:00:00"},   // march 1, 01:00 PST
+		{ID: 0, Username: "ana", CreatedAt: "2026-03-01 07:00:00"},   // feb 28, 23:00 PST
+	}
+	want := []struct {
+		day   int
+		date  string
+		posts []int
+	}{
+		{9, "March 9, 2026", []int{6}},
+		{8, "March 8, 2026", []int{5}},
+		{3, "March 3, 2026", []int{4}},
+		{2, "March 2, 2026", []int{3}},
+		{1, "March 1, 2026", []int{2, 1}},
+		{0, "February 28, 2026", []int{0}},
+	}
+
+	groups := groupPostsByDayFixed(journal, posts)
+	if len(groups) != len(want) {
+		t.Fatalf("got %d days, want %d: %+v", len(groups), len(want), groups)
+	}
+	for i, group := range groups {
+		var ids []int
+		for _, post := range group.Posts {
+			ids = append(ids, post.ID)
+		}
+		if group.DayNumber != want[i].day || group.Date != want[i].date || !slices.Equal(ids, want[i].posts) {
+			t.Errorf("day %d (%s) has %v, want day %d (%s) with %v", group.DayNumber, group.Date, ids, want[i].day, want[i].date, want[i].posts)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// keeps media in an S3-compatible bucket (AWS, MinIO, R2...) using path
+// style requests signed with SigV4. the bucket (or TERRACOTTA_S3_PUBLIC_URL
+// in front of it) has to be publicly readable, /uploads/ just redirects there.
+// objects are kept under TERRACOTTA_S3_PREFIX, and the upload GC only looks
+// there, so the rest of a shared bucket is left alone
+type s3MediaStore struct {
+	endpoint  string // e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	bucket    string
+	prefix    string // "" or ends in a slash, e.g. "terracotta/"
+	region    string
+	accessKey string
+	secretKey string
+	publicURL string // where browsers fetch objects from
+	client    *http.Client
+}
+
+func newS3MediaStore() (*s3MediaStore, error) {
+	s := &s3MediaStore{
+		endpoint:  strings.TrimSuffix(envString("TERRACOTTA_S3_ENDPOINT", ""), "/"),
+		bucket:    envString("TERRACOTTA_S3_BUCKET", ""),
+		prefix:    strings.Trim(envString("TERRACOTTA_S3_PREFIX", ""), "/"),
+		region:    envString("TERRACOTTA_S3_REGION", "us-east-1"),
+		accessKey: envString("TERRACOTTA_S3_ACCESS_KEY", ""),
+		secretKey: envString("TERRACOTTA_S3_SECRET_KEY", ""),
+		publicURL: strings.TrimSuffix(envString("TERRACOTTA_S3_PUBLIC_URL", ""), "/"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	if s.endpoint == "" || s.bucket == "" || s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("the s3 media store needs TERRACOTTA_S3_ENDPOINT, TERRACOTTA_S3_BUCKET, TERRACOTTA_S3_ACCESS_KEY and TERRACOTTA_S3_SECRET_KEY")
+	}
+	if s.publicURL == "" {
+		s.publicURL = s.endpoint + "/" + s.bucket
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	return s, nil
+}
+
+// the object key a file is stored under
+func (s *s3MediaStore) key(name string) string {
+	return s.prefix + name
+}
+
+func (s *s3MediaStore) Put(name string, data []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", mediaContentType(name))
+	header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	resp, err := s.do("PUT", s.key(name), nil, data, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3MediaStore) Delete(name string) error {
+	resp, err := s.do("DELETE", s.key(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3MediaStore) List() ([]StoredFile, error) {
+	var files []StoredFile
+	query := url.Values{"list-type": {"2"}}
+	if s.prefix != "" {
+		query.Set("prefix", s.prefix)
+	}
+	for {
+		resp, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, s.prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue // not one of ours
+			}
+			files = append(files, StoredFile{Name: name, ModTime: object.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *s3MediaStore) Serve(w http.ResponseWriter, r *http.Request, name string) {
+	http.Redirect(w, r, s.publicURL+"/"+s.key(name), http.StatusFound)
+}
+
+// sends a signed request for an object (or the bucket itself when key is
+// empty). anything but a 2xx comes back as an error
+func (s *s3MediaStore) do(method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	target := s.endpoint + "/" + s.bucket
+	if key != "" {
+		// the prefix's slashes stay slashes
+		segments := strings.Split(key, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		target += "/" + strings.Join(segments, "/")
+	}
+	if len(query) > 0 {
+		target += "?" + strings.ReplaceAll(query.Encode(), "+", "%20")
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, body, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, bytes.TrimSpace(message))
+	}
+	return resp, nil
+}
+
+// adds an AWS SigV4 Authorization header covering every header on the request
+func (s *s3MediaStore) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sessionCookieName = "session"
+const sessionDuration = 30 * 24 * time.Hour
+
+// how often last_seen_at gets bumped, so every request isn't a write
+const sessionTouchInterval = time.Minute
+
+type Session struct {
+	ID         int
+	CreatedAt  string
+	LastSeenAt string
+	ExpiresAt  string
+	UserAgent  string
+	IPAddress  string
+	Current    bool
+}
+
+type SessionsPageData struct {
+	Username  string
+	CSRFToken string
+	Sessions  []Session
+	TimeZone  *time.Location
+}
+
+// random opaque token, used for sessions, csrf and api tokens
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// session and api tokens are only stored hashed, so a leaked db can't be used to log in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// true when the request came in over https (directly or through a proxy)
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// best guess at the client address, only used for display on the sessions page
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// creates a session row for the user and sets the session cookie
+func createSession(w http.ResponseWriter, r *http.Request, userID int) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	// every session gets its own csrf token
+	csrfToken, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO sessions (token_hash, user_id, expires_at, user_agent, ip_address, csrf_token) VALUES (?, ?, datetime('now', ?), ?, ?, ?)",
+		hashToken(token), userID, fmt.Sprintf("+%d seconds", int(sessionDuration.Seconds())),
+		r.UserAgent(), clientIP(r), csrfToken)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionDuration.Seconds()),
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// the session cookie's value. requests with a bearer token skip the csrf
+// check, so they never get to act through the cookie as well
+func sessionCookie(r *http.Request) (string, bool) {
+	if _, ok := bearerToken(r); ok {
+		return "", false
+	}
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// resolves the session cookie to a user, returns ok=false if there isn't a live session
+func getSessionUser(r *http.Request) (userID int, username string, ok bool) {
+	_, userID, username, ok = lookupSession(r)
+	return userID, username, ok
+}
+
+// same as getSessionUser but also returns the session row id
+func lookupSession(r *http.Request) (sessionID int, userID int, username string, ok bool) {
+	token, ok := sessionCookie(r)
+	if !ok {
+		return 0, 0, "", false
+	}
+
+	err := db.QueryRow(`
+		SELECT sessions.id, users.id, users.username
+		FROM sessions
+		INNER JOIN users ON sessions.user_id = users.id
+		WHERE sessions.token_hash = ?
+		  AND sessions.expires_at > datetime('now')
+	`, hashToken(token)).Scan(&sessionID, &userID, &username)
+	if err != nil {
+		return 0, 0, "", false
+	}
+
+	// track last seen, but only every so often
+	_, err = db.Exec(
+		"UPDATE sessions SET last_seen_at = CURRENT_TIMESTAMP WHERE id = ? AND last_seen_at < datetime('now', ?)",
+		sessionID, fmt.Sprintf("-%d seconds", int(sessionTouchInterval.Seconds())))
+	if err != nil {
+		log.Printf("Error updating session last seen: %v", err)
+	}
+	return sessionID, userID, username, true
+}
+
+// revokes the session server-side and clears the cookie
+func destroySession(w http.ResponseWriter, r *http.Request) {
+	if token, ok := sessionCookie(r); ok {
+		_, err := db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(token))
+		if err != nil {
+			log.Printf("Error revoking session: %v", err)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1, // kills it
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// removes expired sessions so the table doesn't grow forever
+func purgeExpiredSessions() {
+	_, err := db.Exec("DELETE FROM sessions WHERE expires_at <= datetime('now')")
+	if err != nil {
+		log.Printf("Error purging expired sessions: %v", err)
+	}
+}
+
+// active sessions page
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	currentID, userID, username, ok := lookupSession(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, created_at, last_seen_at, expires_at, user_agent, ip_address
+		FROM sessions
+		WHERE user_id = ?
+		  AND expires_at > datetime('now')
+		ORDER BY last_seen_at DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.UserAgent, &s.IPAddress); err != nil {
+			log.Println("Scan error:", err)
+			continue
+		}
+		s.Current = s.ID == currentID
+		sessions = append(sessions, s)
+	}
+
+	data := SessionsPageData{
+		Username:  username,
+		CSRFToken: csrfToken(w, r),
+		Sessions:  sessions,
+		TimeZone:  userLocation(username, time.UTC),
+	}
+	templates.ExecuteTemplate(w, "sessions.html", data)
+}
+
+// revoke a single session
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+		return
+	}
+
+	currentID, userID, _, ok := lookupSession(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	sessionID, err := strconv.Atoi(r.FormValue("session_id"))
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	// scoped to user_id so you can only revoke your own sessions
+	_, err = db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID)
+	if err != nil {
+		http.Error(w, "Failed to revoke session", 500)
+		return
+	}
+
+	if sessionID == currentID {
+		destroySession(w, r)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+}
+
+// log out everywhere
+func revokeAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+		return
+	}
+
+	_, userID, _, ok := lookupSession(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		http.Error(w, "Failed to revoke sessions", 500)
+		return
+	}
+
+	destroySession(w, r)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,66 @@
+// uploads images as soon as they're picked in an attachments input, then
+// attaches them to the post by id with an alt text box for each.
+// usage: <input type="file" name="image" multiple data-alt-target="id of a container">
+document.querySelectorAll('input[type="file"][data-alt-target]').forEach(function (input) {
+    const container = document.getElementById(input.dataset.altTarget);
+    const csrfToken = input.form.querySelector('input[name="csrf_token"]').value;
+
+    function addPending(file, media) {
+        const label = document.createElement('label');
+        label.textContent = 'Alt text for ' + file.name;
+
+        const id = document.createElement('input');
+        id.type = 'hidden';
+        id.name = 'media_id';
+        id.value = media.id;
+
+        const alt = document.createElement('input');
+        alt.type = 'text';
+        alt.name = 'media_alt';
+        alt.required = true;
+        alt.placeholder = 'Describe the image';
+
+        const preview = document.createElement('img');
+        preview.src = media.thumb_url || media.url;
+        preview.alt = '';
+        preview.height = 60;
+
+        label.append(id, preview, alt);
+        container.appendChild(label);
+    }
+
+    function showError(file, message) {
+        const error = document.createElement('p');
+        error.className = 'upload-error';
+        error.textContent = file.name + ': ' + message;
+        container.appendChild(error);
+    }
+
+    input.addEventListener('change', function () {
+        const files = Array.from(input.files);
+        // the files are uploaded here, don't send them again with the form
+        input.value = '';
+
+        files.forEach(function (file) {
+            const body = new FormData();
+            body.append('image', file);
+
+            fetch('/api/v1/media', {
+                method: 'POST',
+                headers: { 'X-CSRF-Token': csrfToken },
+                body: body,
+            })
+                .then(function (resp) {
+                    return resp.json().then(function (data) {
+                        if (!resp.ok) {
+                            throw new Error(data.error || resp.statusText);
+                        }
+                        addPending(file, data);
+                    });
+                })
+                .catch(function (err) {
+                    showError(file, err.message);
+                });
+        });
+    });
+});
@@ -0,0 +1,32 @@
+// adds a preview button to a composer textarea that shows the content
+// rendered the way the post will look.
+// usage: <textarea name="content" data-preview-target="id of a container">
+document.querySelectorAll('textarea[data-preview-target]').forEach(function (textarea) {
+    const container = document.getElementById(textarea.dataset.previewTarget);
+    const csrfToken = textarea.form.querySelector('input[name="csrf_token"]').value;
+
+    const button = document.createElement('button');
+    button.type = 'button';
+    button.textContent = 'Preview';
+    textarea.after(button);
+
+    button.addEventListener('click', function () {
+        fetch('/api/v1/preview', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+            body: JSON.stringify({ content: textarea.value }),
+        })
+            .then(function (resp) {
+                return resp.json().then(function (data) {
+                    if (!resp.ok) {
+                        throw new Error(data.error || resp.statusText);
+                    }
+                    // already sanitized by the server
+                    container.innerHTML = data.html;
+                });
+            })
+            .catch(function (err) {
+                container.textContent = 'Preview failed: ' + err.message;
+            });
+    });
+});
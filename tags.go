@@ -0,0 +1,476 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// tag pages: /tag/{name} is a feed of the posts with that tag and /tags
+// lists every tag with how many posts it has and when it was last used.
+//
+// tag names are normalized before they're stored, so "Go", "go " and "#go"
+// are the same tag. an alias maps another name to a tag ("golang" -> "go"),
+// and merging a tag into another moves its posts over and leaves its name
+// behind as an alias
+
+// longest tag name, in characters
+const maxTagLength = 32
+
+// whether replies can have tags too (TERRACOTTA_REPLY_TAGS)
+var replyTagsEnabled = envBool("TERRACOTTA_REPLY_TAGS", false)
+
+var errReplyTags = errors.New("replies can't have tags")
+
+type invalidTagError struct {
+	tag    string
+	reason string
+}
+
+func (e invalidTagError) Error() string {
+	return fmt.Sprintf("invalid tag %q: %s", e.tag, e.reason)
+}
+
+// how far back a tag's recent post count looks
+const recentTagWindow = "-7 days"
+
+type TagPageData struct {
+	Username   string         `json:"username"`
+	CSRFToken  string         `json:"-"`
+	Tag        string         `json:"tag"`
+	Posts      []Post         `json:"posts"`
+	Pagination *Pagination    `json:"pagination,omitempty"`
+	TimeZone   *time.Location `json:"-"`
+}
+
+type TagIndexPageData struct {
+	Username  string         `json:"username"`
+	CSRFToken string         `json:"-"`
+	Sort      string         `json:"sort"`
+	Tags      []Tag          `json:"tags"`
+	TimeZone  *time.Location `json:"-"`
+}
+
+// the canonical form of a tag name: no leading #, unicode normalized
+// (NFKC) and case folded, with spaces turned into dashes. it can only have
+// letters, numbers, - and _, and needs at least one letter
+func normalizeTag(name string) (string, error) {
+	tag := strings.TrimLeft(strings.TrimSpace(name), "#")
+	tag = norm.NFKC.String(cases.Fold().String(norm.NFKC.String(tag)))
+	tag = strings.Join(strings.Fields(tag), "-")
+
+	switch {
+	case tag == "":
+		return "", invalidTagError{name, "it's empty"}
+	case utf8.RuneCountInString(tag) > maxTagLength:
+		return "", invalidTagError{name, fmt.Sprintf("it's longer than %d characters", maxTagLength)}
+	case strings.ContainsFunc(tag, func(r rune) bool { return !isTagRune(r) }):
+		return "", invalidTagError{name, "it can only have letters, numbers, - and _"}
+	case !strings.ContainsFunc(tag, unicode.IsLetter):
+		return "", invalidTagError{name, "it needs a letter"}
+	}
+	return tag, nil
+}
+
+func isTagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsDigit(r) || r == '_' || r == '-'
+}
+
+// normalizes a list of tags from a form or request, dropping duplicates.
+// the first invalid tag is an error
+func normalizeTags(names []string) ([]string, error) {
+	var tags []string
+	for _, name := range names {
+		tag, err := normalizeTag(name)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// *sql.DB or *sql.Tx, so lookups can run inside the caller's transaction
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// the tag a name refers to: its normalized form, or the tag that's aliased
+// to. q is the transaction the tag is about to be used in, or db
+func resolveTag(q queryRower, name string) (string, error) {
+	tag, err := normalizeTag(name)
+	if err != nil {
+		return "", err
+	}
+
+	var target string
+	err = q.QueryRow(`
+		SELECT tags.name
+		FROM tag_aliases
+		INNER JOIN tags ON tags.id = tag_aliases.tag_id
+		WHERE tag_aliases.alias = ?
+	`, tag).Scan(&target)
+	if err == sql.ErrNoRows {
+		return tag, nil
+	} else if err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// moves every post from one tag to another and deletes the first one. a
+// post that had both keeps one. aliases of the old tag follow it
+func mergeTagRows(tx *sql.Tx, fromID, intoID int) error {
+	statements := []string{
+		"UPDATE OR IGNORE post_tags SET tag_id = ?1 WHERE tag_id = ?2",
+		// what's left was already on the post under the other tag
+		"DELETE FROM post_tags WHERE tag_id = ?2",
+		"UPDATE tag_aliases SET tag_id = ?1 WHERE tag_id = ?2",
+		"DELETE FROM tags WHERE id = ?2",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, intoID, fromID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merges the tag named from into the tag named into, and makes from an
+// alias of it
+func mergeTags(from, into string) error {
+	from, err := normalizeTag(from)
+	if err != nil {
+		return err
+	}
+	into, err = resolveTag(db, into)
+	if err != nil {
+		return err
+	}
+	if from == into {
+		return fmt.Errorf("can't merge %q into itself", from)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var fromID, intoID int
+	if err := tx.QueryRow("SELECT id FROM tags WHERE name = ?", from).Scan(&fromID); err == sql.ErrNoRows {
+		return fmt.Errorf("no tag %q", from)
+	} else if err != nil {
+		return err
+	}
+	if err := tx.QueryRow("SELECT id FROM tags WHERE name = ?", into).Scan(&intoID); err == sql.ErrNoRows {
+		return fmt.Errorf("no tag %q", into)
+	} else if err != nil {
+		return err
+	}
+
+	if err := mergeTagRows(tx, fromID, intoID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO tag_aliases (alias, tag_id) VALUES (?, ?)", from, intoID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// makes alias another name for tag. an alias can't be a tag in use, merge
+// that instead
+func addTagAlias(alias, tag string) error {
+	alias, err := normalizeTag(alias)
+	if err != nil {
+		return err
+	}
+	tag, err = resolveTag(db, tag)
+	if err != nil {
+		return err
+	}
+	if alias == tag {
+		return fmt.Errorf("can't alias %q to itself", alias)
+	}
+
+	var exists int
+	err = db.QueryRow("SELECT 1 FROM tags WHERE name = ?", alias).Scan(&exists)
+	if err == nil {
+		return fmt.Errorf("%q is already a tag, merge it instead", alias)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	var tagID int
+	if err := db.QueryRow("SELECT id FROM tags WHERE name = ?", tag).Scan(&tagID); err == sql.ErrNoRows {
+		return fmt.Errorf("no tag %q", tag)
+	} else if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO tag_aliases (alias, tag_id) VALUES (?, ?)", alias, tagID)
+	return err
+}
+
+func removeTagAlias(alias string) error {
+	alias, err := normalizeTag(alias)
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec("DELETE FROM tag_aliases WHERE alias = ?", alias)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no alias %q", alias)
+	}
+	return nil
+}
+
+// renames every tag to its normalized form, merging tags that end up with
+// the same name. tags that can't be normalized are left alone. returns how
+// many tags changed
+func normalizeExistingTags(tx *sql.Tx) (int, error) {
+	rows, err := tx.Query("SELECT id, name FROM tags ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+	type tagRow struct {
+		id   int
+		name string
+	}
+	var all []tagRow
+	for rows.Next() {
+		var t tagRow
+		if err := rows.Scan(&t.id, &t.name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		all = append(all, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, t := range all {
+		name, err := normalizeTag(t.name)
+		if err != nil {
+			log.Printf("Leaving tag %q as it is: %v", t.name, err)
+			continue
+		}
+		if name == t.name {
+			continue
+		}
+
+		var intoID int
+		err = tx.QueryRow("SELECT id FROM tags WHERE name = ?", name).Scan(&intoID)
+		if err == sql.ErrNoRows {
+			_, err = tx.Exec("UPDATE tags SET name = ? WHERE id = ?", name, t.id)
+		} else if err == nil {
+			err = mergeTagRows(tx, t.id, intoID)
+		}
+		if err != nil {
+			return 0, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// `terracotta tags merge|alias|unalias|normalize`
+func runTagsCommand(args []string) {
+	usage := "usage: terracotta tags merge <from> <into> | alias <alias> <tag> | unalias <alias> | normalize"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch {
+	case args[0] == "merge" && len(args) == 3:
+		err = mergeTags(args[1], args[2])
+	case args[0] == "alias" && len(args) == 3:
+		err = addTagAlias(args[1], args[2])
+	case args[0] == "unalias" && len(args) == 2:
+		err = removeTagAlias(args[1])
+	case args[0] == "normalize" && len(args) == 1:
+		var tx *sql.Tx
+		tx, err = db.Begin()
+		if err != nil {
+			break
+		}
+		defer tx.Rollback()
+		var changed int
+		if changed, err = normalizeExistingTags(tx); err == nil {
+			if err = tx.Commit(); err == nil {
+				log.Printf("Normalized %d tags", changed)
+			}
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// whether a post with this parent can have tags
+func canHaveTags(parentID *int) bool {
+	return parentID == nil || replyTagsEnabled
+}
+
+// for the templates
+func (p Post) Taggable() bool {
+	return canHaveTags(p.ParentID)
+}
+
+// replaces the post's tags with the given ones, as part of editPost.
+// hashtags in the post's content always stay, they go when they're edited
+// out. errReplyTags if the post can't have tags
+func setPostTags(tx *sql.Tx, postID int, parentID *int, content string, tags []string) error {
+	if !canHaveTags(parentID) {
+		if len(tags) > 0 {
+			return errReplyTags
+		}
+		return nil
+	}
+
+	var keep []string
+	for _, tag := range tags {
+		name, err := resolveTag(tx, tag)
+		if err != nil {
+			return err
+		}
+		keep = append(keep, name)
+	}
+	// hashtags that aren't valid tags were never linked or tagged
+	for _, hashtag := range extractContentRefs(content).Hashtags {
+		name, err := resolveTag(tx, hashtag)
+		var invalidTag invalidTagError
+		if errors.As(err, &invalidTag) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		keep = append(keep, name)
+	}
+
+	args := []any{postID}
+	for _, name := range keep {
+		args = append(args, name)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(keep)), ",")
+	_, err := tx.Exec(`
+		DELETE FROM post_tags
+		WHERE post_id = ?
+		  AND tag_id NOT IN (SELECT id FROM tags WHERE name IN (`+placeholders+`))
+	`, args...)
+	if err != nil {
+		return err
+	}
+	return insertPostTags(tx, postID, keep)
+}
+
+// deletes tags that no post has anymore, unless an alias points at them.
+// returns how many went
+func cleanupUnusedTags() (int64, error) {
+	result, err := db.Exec(`
+		DELETE FROM tags
+		WHERE NOT EXISTS (SELECT 1 FROM post_tags WHERE post_tags.tag_id = tags.id)
+		  AND NOT EXISTS (SELECT 1 FROM tag_aliases WHERE tag_aliases.tag_id = tags.id)
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// one page of posts with the tag, newest first
+func getTagPosts(name string, page PageRequest) ([]Post, Pagination, error) {
+	return getFeedPosts(`posts.id IN (
+		SELECT post_tags.post_id
+		FROM post_tags
+		INNER JOIN tags ON tags.id = post_tags.tag_id
+		WHERE tags.name = ?
+	)`, page, name)
+}
+
+// "popular" or "recent", from ?sort=
+func tagSortFromQuery(r *http.Request) string {
+	if r.URL.Query().Get("sort") == "recent" {
+		return "recent"
+	}
+	return "popular"
+}
+
+// tag feed, /tag/{name}. a tag nobody has used yet is just an empty feed,
+// hashtags in replies link here too. other spellings and aliases redirect
+// to the canonical tag
+func tagHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := resolveTag(db, r.PathValue("name"))
+	var invalid invalidTagError
+	if errors.As(err, &invalid) {
+		http.Error(w, "Tag not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if name != r.PathValue("name") {
+		target := "/tag/" + url.PathEscape(name)
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	posts, pagination, err := getTagPosts(name, pageRequestFromQuery(r))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	templates.ExecuteTemplate(w, "tag.html", TagPageData{
+		Username:   getUsername(r),
+		CSRFToken:  csrfToken(w, r),
+		Tag:        name,
+		Posts:      posts,
+		Pagination: &pagination,
+		TimeZone:   viewerLocation(r, time.UTC),
+	})
+}
+
+// tag index, /tags?sort=popular|recent
+func tagIndexHandler(w http.ResponseWriter, r *http.Request) {
+	sort := tagSortFromQuery(r)
+	tags, err := getAllTags(sort)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	templates.ExecuteTemplate(w, "tags.html", TagIndexPageData{
+		Username:  getUsername(r),
+		CSRFToken: csrfToken(w, r),
+		Sort:      sort,
+		Tags:      tags,
+		TimeZone:  viewerLocation(r, time.UTC),
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		name, want string // want "" if the name is invalid
+	}{
+		{"go", "go"},
+		{"Go", "go"},
+		{"GO ", "go"},
+		{"#go", "go"},
+		{"##go", "go"},
+		{"  Machine Learning  ", "machine-learning"},
+		{"new\tyear", "new-year"},
+		{"snake_case", "snake_case"},
+		{"web3", "web3"},
+		{"Straße", "strasse"},
+		{"ＦＵＬＬＷＩＤＴＨ", "fullwidth"},
+		{"café", "café"},
+		{"cafe\u0301", "caf\u00e9"}, // decomposed é
+		{"ǅ", "dž"},                 // one letter, folded and decomposed
+		{"日本語", "日本語"},
+		{strings.Repeat("a", maxTagLength), strings.Repeat("a", maxTagLength)},
+		{strings.Repeat("é", maxTagLength), strings.Repeat("é", maxTagLength)},
+
+		{"", ""},
+		{"#", ""},
+		{"   ", ""},
+		{"2024", ""},
+		{"1-2_3", ""},
+		{"c++", ""},
+		{"c#", ""},
+		{"a.b", ""},
+		{"<script>", ""},
+		{"go/rust", ""},
+		{"emoji😀", ""},
+		{strings.Repeat("a", maxTagLength+1), ""},
+	}
+	for _, test := range tests {
+		got, err := normalizeTag(test.name)
+		if test.want == "" {
+			var invalid invalidTagError
+			if !errors.As(err, &invalid) {
+				t.Errorf("normalizeTag(%q) = %q, %v, want an invalidTagError", test.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("normalizeTag(%q) = %q, %v, want %q", test.name, got, err, test.want)
+		}
+		// and it's idempotent
+		if again, err := normalizeTag(got); err != nil || again != got {
+			t.Errorf("normalizeTag(%q) = %q, %v, isn't stable", got, again, err)
+		}
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	tags, err := normalizeTags([]string{"Go", "rust", "#go", "GO", "Rust "})
+	if err != nil || !slices.Equal(tags, []string{"go", "rust"}) {
+		t.Errorf("normalizeTags = %q, %v, want [go rust]", tags, err)
+	}
+	if _, err := normalizeTags([]string{"go", "c++"}); err == nil {
+		t.Error("normalizeTags with an invalid tag succeeded")
+	}
+}
+
+// only names normalizeTag accepts are hashtags
+func TestScanHashtag(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"go", "go"},
+		{"Go!", "Go"},
+		{"go, rust", "go"},
+		{"go-", "go"},
+		{"snake_case.", "snake_case"},
+		{"日本語です", "日本語です"},
+		{"web3 rocks", "web3"},
+		{"1", ""},
+		{"2024-01-01", ""},
+		{"", ""},
+		{" go", ""},
+		{strings.Repeat("a", maxTagLength), strings.Repeat("a", maxTagLength)},
+		{strings.Repeat("a", maxTagLength+1), ""},
+	}
+	for _, test := range tests {
+		if got := scanHashtag(test.text); got != test.want {
+			t.Errorf("scanHashtag(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+// aliases are resolved in the transaction the post's tags are saved in
+func TestInsertPostTagsResolvesInTransaction(t *testing.T) {
+	openTestDB(t)
+	postID, err := createPost("alice", "hello", nil, "regular", nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		"INSERT INTO tags (name) VALUES ('go')",
+		"INSERT INTO tag_aliases (alias, tag_id) VALUES ('golang', (SELECT id FROM tags WHERE name = 'go'))",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := insertPostTags(tx, postID, []string{"Golang", "c++"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tags := getPostTagsForTest(t, postID); !slices.Equal(tags, []string{"go"}) {
+		t.Errorf("post is tagged %q, want [go]", tags)
+	}
+}
+
+func getPostTagsForTest(t *testing.T, postID int) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT tags.name FROM post_tags INNER JOIN tags ON tags.id = post_tags.tag_id WHERE post_tags.post_id = ? ORDER BY tags.name", postID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		tags = append(tags, name)
+	}
+	return tags
+}
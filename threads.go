@@ -0,0 +1,75 @@
+package main
+
+// replies nest: a reply can have replies of its own. getPostReplies loads
+// the whole tree under a post, the thread page shows it down to
+// maxReplyDepth and links to deeper parts as their own thread
+
+// how many levels of replies the thread page shows before "continue this
+// thread"
+const maxReplyDepth = 5
+
+// a reply on the thread page, with how deep it sits in the tree
+type ThreadReply struct {
+	Post
+	Depth    int  // 0 for direct replies
+	Continue bool // it has replies that are too deep to show here
+}
+
+// turns the flat list of replies under rootID (ordered oldest first) into a
+// tree, and counts each reply's descendants
+func buildReplyTree(rootID int, replies []Post) []Post {
+	children := make(map[int][]Post)
+	for _, reply := range replies {
+		if reply.ParentID != nil {
+			children[*reply.ParentID] = append(children[*reply.ParentID], reply)
+		}
+	}
+
+	var build func(parentID int) []Post
+	build = func(parentID int) []Post {
+		nodes := children[parentID]
+		for i := range nodes {
+			nodes[i].Replies = build(nodes[i].ID)
+			nodes[i].ReplyCount = countReplies(nodes[i].Replies)
+		}
+		return nodes
+	}
+	return build(rootID)
+}
+
+// how many replies are in the tree, nested ones included
+func countReplies(replies []Post) int {
+	count := len(replies)
+	for _, reply := range replies {
+		count += countReplies(reply.Replies)
+	}
+	return count
+}
+
+// calls fn for every reply in the tree, parents before their replies
+func walkReplies(replies []Post, fn func(reply *Post)) {
+	for i := range replies {
+		fn(&replies[i])
+		walkReplies(replies[i].Replies, fn)
+	}
+}
+
+// the post's reply tree in display order, cut off at maxReplyDepth
+func (p *Post) ThreadReplies() []ThreadReply {
+	var flat []ThreadReply
+	var walk func(replies []Post, depth int)
+	walk = func(replies []Post, depth int) {
+		for _, reply := range replies {
+			item := ThreadReply{Post: reply, Depth: depth}
+			if depth == maxReplyDepth-1 && len(reply.Replies) > 0 {
+				item.Continue = true
+			}
+			flat = append(flat, item)
+			if !item.Continue {
+				walk(reply.Replies, depth+1)
+			}
+		}
+	}
+	walk(p.Replies, 0)
+	return flat
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // zones work even where the system has no zoneinfo
+)
+
+// time zones. timestamps are stored in UTC and shown in the viewer's zone,
+// which they pick on /settings (UTC until they do). journals have a zone of
+// their own: a journal post's day is the date it was posted where its
+// author is, or in the journal's zone if the author hasn't picked one
+
+var locationCache sync.Map // zone name -> *time.Location
+
+// time.LoadLocation, but cached, and only for IANA names like
+// "America/Los_Angeles" (or "UTC")
+func loadLocation(name string) (*time.Location, error) {
+	if cached, ok := locationCache.Load(name); ok {
+		return cached.(*time.Location), nil
+	}
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	locationCache.Store(name, loc)
+	return loc, nil
+}
+
+// the zone, or UTC if it's unset or doesn't load anymore
+func locationOrUTC(name string) *time.Location {
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := loadLocation(name)
+	if err != nil {
+		log.Printf("Error loading time zone: %v", err)
+		return time.UTC
+	}
+	return loc
+}
+
+// the user's time zone, "" if they haven't picked one
+func getUserTimeZone(username string) (string, error) {
+	var zone sql.NullString
+	err := db.QueryRow("SELECT time_zone FROM users WHERE username = ?", username).Scan(&zone)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return zone.String, err
+}
+
+// the user's time zone, or fallback if they haven't picked one
+func userLocation(username string, fallback *time.Location) *time.Location {
+	zone, err := getUserTimeZone(username)
+	if err != nil {
+		log.Printf("Error loading time zone of %s: %v", username, err)
+	}
+	if zone == "" {
+		return fallback
+	}
+	return locationOrUTC(zone)
+}
+
+// the time zones the given users picked, users without one are left out
+func userLocations(usernames []string) (map[string]*time.Location, error) {
+	locations := make(map[string]*time.Location)
+	if len(usernames) == 0 {
+		return locations, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(usernames)), ",")
+	args := make([]any, len(usernames))
+	for i, name := range usernames {
+		args[i] = name
+	}
+	rows, err := db.Query("SELECT username, time_zone FROM users WHERE time_zone IS NOT NULL AND username IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username, zone string
+		if err := rows.Scan(&username, &zone); err != nil {
+			return nil, err
+		}
+		locations[username] = locationOrUTC(zone)
+	}
+	return locations, rows.Err()
+}
+
+// the zone to show timestamps in: the logged in user's, or fallback
+func viewerLocation(r *http.Request, fallback *time.Location) *time.Location {
+	if _, username, ok := getAuthUser(r, scopeRead); ok {
+		return userLocation(username, fallback)
+	}
+	return fallback
+}
+
+// timestamps come back from sqlite in a couple of formats depending on how
+// they were read
+func parseTimestamp(value string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02 15:04:05", value)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, value)
+	}
+	return t, err
+}
+
+// template func, {{localtime .CreatedAt $.TimeZone}}. shows a stored UTC
+// timestamp in loc, anything it can't parse is shown as it is
+func localTime(value any, loc *time.Location) string {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	var t time.Time
+	switch v := value.(type) {
+	case time.Time:
+		t = v
+	case *string:
+		if v == nil {
+			return ""
+		}
+		return localTime(*v, loc)
+	case string:
+		var err error
+		if t, err = parseTimestamp(v); err != nil {
+			return v
+		}
+	default:
+		return fmt.Sprint(value)
+	}
+	return t.In(loc).Format("2006-01-02 15:04 MST")
+}
+
+var templateFuncs = template.FuncMap{
+	"localtime": localTime,
+}
+
+type SettingsPageData struct {
+	Username  string
+	CSRFToken string
+	TimeZone  string
+	Saved     bool
+}
+
+// /settings, where users pick their time zone
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, username, ok := getSessionUser(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	data := SettingsPageData{
+		Username:  username,
+		CSRFToken: csrfToken(w, r),
+	}
+
+	if r.Method == http.MethodPost {
+		// empty goes back to UTC
+		zone := strings.TrimSpace(r.FormValue("time_zone"))
+		var value *string
+		if zone != "" {
+			if _, err := loadLocation(zone); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			value = &zone
+		}
+		if _, err := db.Exec("UPDATE users SET time_zone = ? WHERE id = ?", value, userID); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		data.Saved = true
+	}
+
+	zone, err := getUserTimeZone(username)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	data.TimeZone = zone
+	templates.ExecuteTemplate(w, "settings.html", data)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// personal api tokens, for scripts that post without a browser. sent as
+// `Authorization: Bearer tc_...`
+
+const apiTokenPrefix = "tc_"
+
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+type APIToken struct {
+	ID         int
+	Name       string
+	Scope      string
+	CreatedAt  string
+	LastUsedAt string
+}
+
+type TokensPageData struct {
+	Username  string
+	CSRFToken string
+	Tokens    []APIToken
+	NewToken  string // only shown once, right after creation
+	TimeZone  *time.Location
+}
+
+// returns the bearer token from the Authorization header, if any
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "", false
+	}
+	token, found := strings.CutPrefix(auth, "Bearer ")
+	if !found {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// resolves an api token to its user. write scope also allows reads
+func getTokenUser(token, scope string) (userID int, username string, ok bool) {
+	var tokenID int
+	var tokenScope string
+	err := db.QueryRow(`
+		SELECT api_tokens.id, api_tokens.scope, users.id, users.username
+		FROM api_tokens
+		INNER JOIN users ON api_tokens.user_id = users.id
+		WHERE api_tokens.token_hash = ?
+	`, hashToken(token)).Scan(&tokenID, &tokenScope, &userID, &username)
+	if err != nil {
+		return 0, "", false
+	}
+
+	if scope == scopeWrite && tokenScope != scopeWrite {
+		return 0, "", false
+	}
+
+	_, err = db.Exec("UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?", tokenID)
+	if err != nil {
+		log.Printf("Error updating api token last used: %v", err)
+	}
+	return userID, username, true
+}
+
+// resolves the user behind a request. a request with a bearer token is only
+// ever authenticated by that token, never by the session cookie, which is
+// what lets bearer requests skip the csrf check
+func getAuthUser(r *http.Request, scope string) (userID int, username string, ok bool) {
+	if token, found := bearerToken(r); found {
+		return getTokenUser(token, scope)
+	}
+	return getSessionUser(r)
+}
+
+// api tokens page
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	userID, username, ok := getSessionUser(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	data := TokensPageData{
+		Username:  username,
+		CSRFToken: csrfToken(w, r),
+		TimeZone:  userLocation(username, time.UTC),
+	}
+
+	// creating a token renders the page directly so the token can be shown once
+	if r.Method == http.MethodPost {
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			http.Error(w, "Missing token name", http.StatusBadRequest)
+			return
+		}
+
+		scope := r.FormValue("scope")
+		if scope != scopeRead && scope != scopeWrite {
+			http.Error(w, "Invalid scope", http.StatusBadRequest)
+			return
+		}
+
+		token, err := generateToken()
+		if err != nil {
+			http.Error(w, "Failed to generate token", 500)
+			return
+		}
+		token = apiTokenPrefix + token
+
+		_, err = db.Exec("INSERT INTO api_tokens (user_id, name, token_hash, scope) VALUES (?, ?, ?, ?)",
+			userID, name, hashToken(token), scope)
+		if err != nil {
+			http.Error(w, "Failed to create token", 500)
+			return
+		}
+		data.NewToken = token
+	}
+
+	rows, err := db.Query(`
+		SELECT id, name, scope, created_at, last_used_at
+		FROM api_tokens
+		WHERE user_id = ?
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t APIToken
+		var lastUsed sql.NullString
+		if err := rows.Scan(&t.ID, &t.Name, &t.Scope, &t.CreatedAt, &lastUsed); err != nil {
+			log.Println("Scan error:", err)
+			continue
+		}
+		t.LastUsedAt = lastUsed.String
+		data.Tokens = append(data.Tokens, t)
+	}
+
+	templates.ExecuteTemplate(w, "tokens.html", data)
+}
+
+// revoke an api token
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+		return
+	}
+
+	userID, _, ok := getSessionUser(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(r.FormValue("token_id"))
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	// scoped to user_id so you can only revoke your own tokens
+	_, err = db.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ?", tokenID, userID)
+	if err != nil {
+		http.Error(w, "Failed to revoke token", 500)
+		return
+	}
+	http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trending tags for the timeline sidebar. a background worker scores tags
+// for each window every few minutes and keeps the result in memory, so
+// pages just read the cache.
+//
+// every post in the window adds (1 + its likes) to each of its tags,
+// halved for every quarter of the window that has passed since it was
+// posted, so a tag trends on recent posts people like
+
+// windows to score, comma separated, with h or d units
+// (TERRACOTTA_TRENDING_WINDOWS)
+var trendingWindows = parseTrendingWindows(envString("TERRACOTTA_TRENDING_WINDOWS", "1h,24h,7d"))
+
+// how often the scores are recomputed (TERRACOTTA_TRENDING_INTERVAL_MINUTES)
+var trendingInterval = time.Duration(envInt("TERRACOTTA_TRENDING_INTERVAL_MINUTES", 5)) * time.Minute
+
+// how many tags each window keeps
+const trendingTagLimit = 10
+
+type TrendingWindow struct {
+	Name     string // as configured, e.g. "24h"
+	Duration time.Duration
+}
+
+type TrendingTag struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+	Posts int     `json:"posts"` // posts with the tag in the window
+}
+
+// the sidebar, and the api response
+type TrendingTags struct {
+	Window     string        `json:"window"`
+	Windows    []string      `json:"windows"` // all the configured ones
+	Tags       []TrendingTag `json:"tags"`
+	ComputedAt time.Time     `json:"computed_at"`
+}
+
+var trendingCache struct {
+	sync.RWMutex
+	byWindow   map[string][]TrendingTag
+	computedAt time.Time
+}
+
+// parses "1h,24h,7d". bad entries are logged and skipped, and if nothing's
+// left it falls back to 24h
+func parseTrendingWindows(value string) []TrendingWindow {
+	var windows []TrendingWindow
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		d, err := parseWindowDuration(name)
+		if err != nil {
+			log.Printf("Ignoring trending window %q: %v", name, err)
+			continue
+		}
+		windows = append(windows, TrendingWindow{Name: name, Duration: d})
+	}
+	if len(windows) == 0 {
+		windows = []TrendingWindow{{Name: "24h", Duration: 24 * time.Hour}}
+	}
+	return windows
+}
+
+// like time.ParseDuration, plus days ("7d")
+func parseWindowDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("window must be positive")
+	}
+	return d, nil
+}
+
+// the configured window with that name, or the default: 24h if it's
+// configured, otherwise the first one
+func trendingWindow(name string) TrendingWindow {
+	for _, w := range trendingWindows {
+		if w.Name == name {
+			return w
+		}
+	}
+	for _, w := range trendingWindows {
+		if w.Name == "24h" {
+			return w
+		}
+	}
+	return trendingWindows[0]
+}
+
+// scores tags over every window from one pass over the posts in the longest
+func computeTrendingTags(now time.Time) (map[string][]TrendingTag, error) {
+	longest := slices.MaxFunc(trendingWindows, func(a, b TrendingWindow) int {
+		return cmp.Compare(a.Duration, b.Duration)
+	}).Duration
+
+	rows, err := db.Query(`
+		SELECT
+			tags.name,
+			posts.created_at,
+			(SELECT COUNT(*) FROM likes WHERE likes.post_id = posts.id) AS likes
+		FROM post_tags
+		INNER JOIN tags ON tags.id = post_tags.tag_id
+		INNER JOIN posts ON posts.id = post_tags.post_id
+		WHERE posts.deleted_at IS NULL
+		  AND posts.created_at > datetime('now', ?)
+	`, fmt.Sprintf("-%d seconds", int(longest.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scores := make(map[string]map[string]*TrendingTag)
+	for _, w := range trendingWindows {
+		scores[w.Name] = make(map[string]*TrendingTag)
+	}
+
+	for rows.Next() {
+		var name string
+		var createdAt time.Time
+		var likes int
+		if err := rows.Scan(&name, &createdAt, &likes); err != nil {
+			return nil, err
+		}
+		age := now.Sub(createdAt)
+		for _, w := range trendingWindows {
+			if age > w.Duration {
+				continue
+			}
+			tag := scores[w.Name][name]
+			if tag == nil {
+				tag = &TrendingTag{Name: name}
+				scores[w.Name][name] = tag
+			}
+			halfLife := w.Duration / 4
+			tag.Score += float64(1+likes) * math.Pow(0.5, max(age, 0).Seconds()/halfLife.Seconds())
+			tag.Posts++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	byWindow := make(map[string][]TrendingTag)
+	for window, tags := range scores {
+		var ranked []TrendingTag
+		for _, tag := range tags {
+			tag.Score = math.Round(tag.Score*100) / 100
+			ranked = append(ranked, *tag)
+		}
+		slices.SortFunc(ranked, func(a, b TrendingTag) int {
+			return cmp.Or(cmp.Compare(b.Score, a.Score), strings.Compare(a.Name, b.Name))
+		})
+		if len(ranked) > trendingTagLimit {
+			ranked = ranked[:trendingTagLimit]
+		}
+		byWindow[window] = ranked
+	}
+	return byWindow, nil
+}
+
+// the cached trending tags for the window (see trendingWindow), best first
+func getTrendingTags(window string) TrendingTags {
+	trending := TrendingTags{Window: trendingWindow(window).Name}
+	for _, w := range trendingWindows {
+		trending.Windows = append(trending.Windows, w.Name)
+	}
+
+	trendingCache.RLock()
+	defer trendingCache.RUnlock()
+	trending.Tags = trendingCache.byWindow[trending.Window]
+	trending.ComputedAt = trendingCache.computedAt
+	if trending.Tags == nil {
+		trending.Tags = []TrendingTag{}
+	}
+	return trending
+}
+
+func refreshTrendingTags() error {
+	now := time.Now()
+	byWindow, err := computeTrendingTags(now)
+	if err != nil {
+		return err
+	}
+
+	trendingCache.Lock()
+	trendingCache.byWindow = byWindow
+	trendingCache.computedAt = now
+	trendingCache.Unlock()
+	return nil
+}
+
+// keeps the trending cache up to date in the background forever
+func startTrendingWorker() {
+	go func() {
+		for {
+			if err := refreshTrendingTags(); err != nil {
+				log.Printf("Error computing trending tags: %v", err)
+			}
+			time.Sleep(trendingInterval)
+		}
+	}()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploads that aren't referenced yet are left alone for this long, so a file
+// isn't collected between being written and its post being inserted
+const uploadGCGracePeriod = time.Hour
+
+// how often unreferenced uploads get cleaned up (TERRACOTTA_UPLOAD_GC_HOURS)
+var uploadGCInterval = time.Duration(envInt("TERRACOTTA_UPLOAD_GC_HOURS", 24)) * time.Hour
+
+// serves uploaded media from whichever store is configured
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	mediaStore.Serve(w, r, name)
+}
+
+// responsive widths generated next to every uploaded image. images that are
+// already narrower than a size just don't get that variant
+const (
+	thumbImageWidth  = 320
+	mediumImageWidth = 800
+)
+
+// where an uploaded image and its resized variants ended up
+type StoredImage struct {
+	URL       string
+	ThumbURL  string
+	MediumURL string
+	Width     int
+	Height    int
+}
+
+// puts a processed image and its resized variants into the media store
+func storeImage(p *processedImage) (StoredImage, error) {
+	base := generateUniqueFilename("")
+	if err := mediaStore.Put(base+p.ext, p.data); err != nil {
+		return StoredImage{}, err
+	}
+	stored := StoredImage{
+		URL:    "/uploads/" + base + p.ext,
+		Width:  p.width,
+		Height: p.height,
+	}
+
+	// gifs keep their animation, so they're served as-is
+	if p.img == nil {
+		return stored, nil
+	}
+
+	for _, variant := range []struct {
+		width int
+		url   *string
+	}{
+		{thumbImageWidth, &stored.ThumbURL},
+		{mediumImageWidth, &stored.MediumURL},
+	} {
+		if p.width <= variant.width {
+			continue
+		}
+
+		data, err := encodeImage(resizeImage(p.img, variant.width), p.ext)
+		if err != nil {
+			return StoredImage{}, err
+		}
+		filename := base + "_" + strconv.Itoa(variant.width) + p.ext
+		if err := mediaStore.Put(filename, data); err != nil {
+			return StoredImage{}, err
+		}
+		*variant.url = "/uploads/" + filename
+	}
+	return stored, nil
+}
+
+// every upload filename some post or pending upload still points at, resized
+// variants included
+func referencedUploads() (map[string]bool, error) {
+	rows, err := db.Query(`
+		SELECT url FROM post_media WHERE url LIKE '/uploads/%'
+		UNION SELECT thumb_url FROM post_media WHERE thumb_url LIKE '/uploads/%'
+		UNION SELECT medium_url FROM post_media WHERE medium_url LIKE '/uploads/%'
+		UNION SELECT url FROM pending_media WHERE url LIKE '/uploads/%'
+		UNION SELECT thumb_url FROM pending_media WHERE thumb_url LIKE '/uploads/%'
+		UNION SELECT medium_url FROM pending_media WHERE medium_url LIKE '/uploads/%'
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	referenced := make(map[string]bool)
+	for rows.Next() {
+		var imageURL string
+		if err := rows.Scan(&imageURL); err != nil {
+			return nil, err
+		}
+		referenced[strings.TrimPrefix(imageURL, "/uploads/")] = true
+	}
+	return referenced, rows.Err()
+}
+
+// expires old pending uploads, then deletes media that nothing references
+// anymore. returns how many files were removed
+func collectUnusedUploads() (int, error) {
+	if expired, err := expirePendingMedia(); err != nil {
+		return 0, err
+	} else if expired > 0 {
+		log.Printf("Expired %d pending uploads", expired)
+	}
+
+	files, err := mediaStore.List()
+	if err != nil {
+		return 0, err
+	}
+
+	referenced, err := referencedUploads()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, file := range files {
+		if referenced[file.Name] || time.Since(file.ModTime) < uploadGCGracePeriod {
+			continue
+		}
+
+		if err := mediaStore.Delete(file.Name); err != nil {
+			log.Printf("Error removing unused upload %s: %v", file.Name, err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// runs collectUnusedUploads in the background forever
+func startUploadGC() {
+	go func() {
+		for {
+			removed, err := collectUnusedUploads()
+			if err != nil {
+				log.Printf("Error collecting unused uploads: %v", err)
+			} else if removed > 0 {
+				log.Printf("Removed %d unused uploads", removed)
+			}
+			time.Sleep(uploadGCInterval)
+		}
+	}()
+}